@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// ErrBadAttributeColumns - the attribute column configuration is invalid
+var ErrBadAttributeColumns = fmt.Errorf("bad attribute column configuration")
+
+// SQS allows at most this many attributes on a message and the SDK may add one of its own for oversize messages
+var sqsMaxAttributes = 10
+var sdkReservedAttributes = 1
+
+// AttributeColumn - an additional cache table column sent as a message attribute
+type AttributeColumn struct {
+	Column    string // the cache table column
+	Attribute string // and the attribute name
+}
+
+// the attributes we set ourselves
+var reservedAttributes = []string{
+	awssqs.AttributeKeyRecordId,
+	awssqs.AttributeKeyRecordType,
+	awssqs.AttributeKeyRecordSource,
+	awssqs.AttributeKeyRecordOperation,
+	attributeKeyRecordPriority,
+	attributeKeyRecordNote,
+	attributeKeyContentEncoding,
+}
+
+// ParseAttributeColumns - parse a space separated list of column[=attribute] entries, the attribute name is the
+// column name if not specified
+func ParseAttributeColumns(spec string) ([]AttributeColumn, error) {
+
+	entries, err := parseKeyValueSpec(spec, ErrBadAttributeColumns, "column[=attribute]", true)
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make([]AttributeColumn, 0)
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+
+		ac := AttributeColumn{Column: entry.key, Attribute: entry.value}
+		if len(ac.Attribute) == 0 {
+			ac.Attribute = ac.Column
+		}
+
+		if contains(reservedAttributes, ac.Attribute) || seen[ac.Attribute] == true {
+			return nil, fmt.Errorf("%w: attribute [%s] is reserved or already used", ErrBadAttributeColumns, ac.Attribute)
+		}
+
+		seen[ac.Attribute] = true
+		columns = append(columns, ac)
+	}
+
+	return columns, nil
+}
+
+// the column names
+func attributeColumnNames(columns []AttributeColumn) []string {
+
+	names := make([]string, 0, len(columns))
+	for _, c := range columns {
+		names = append(names, c.Column)
+	}
+	return names
+}
+
+// add the attributes for the additional column values to the message. Empty values are not sent (SQS does not allow
+// them) and attributes that would take the message over the SQS limit are dropped
+func addColumnAttributes(message *awssqs.Message, columns []AttributeColumn, values map[string]string) {
+
+	for _, c := range columns {
+		value := values[c.Column]
+		if len(value) == 0 {
+			continue
+		}
+		if len(message.Attribs) >= sqsMaxAttributes-sdkReservedAttributes {
+			log.Printf("WARNING: too many attributes for id %s, %s not sent", messageAttribute(message, awssqs.AttributeKeyRecordId), c.Attribute)
+			continue
+		}
+		message.Attribs = append(message.Attribs, awssqs.Attribute{Name: c.Attribute, Value: value})
+	}
+}
+
+//
+// end of file
+//
@@ -3,38 +3,110 @@ package main
 import (
 	"fmt"
 	"log"
+	"strconv"
 	"strings"
 	"time"
 
-	dbx "github.com/go-ozzo/ozzo-dbx"
-	_ "github.com/lib/pq"
 	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
 )
 
 // ErrNotInCache - item not in the cache
 var ErrNotInCache = fmt.Errorf("item(s) not in cache")
 
+// ErrAmbiguousSource - the record source cannot be determined
+var ErrAmbiguousSource = fmt.Errorf("record source is ambiguous")
+
+// ErrUnknownSource - the record source is not one of the configured data sources
+var ErrUnknownSource = fmt.Errorf("record source is not a configured data source")
+
+// how we handle an id that exists in more than one of the configured data sources
+var SourcePrecedenceOrdered = "ordered" // use the first source in the configured order
+var SourcePrecedenceAll = "all"         // send the record from every source
+
+// additional attribute keys used when the input record specifies them
+var attributeKeyRecordPriority = "priority"
+var attributeKeyRecordNote = "note"
+
 // the maximum number of keys to lookup at once
 var lookupCacheMaxKeyCount = 500
 
 // the maximum number of keys to get at once
 var getCacheMaxKeyCount = 100
 
-// log a warning if any postgres request takes longer than this
+// log a warning if any cache request takes longer than this
 var lookupRequestTimeLimit = int64(300)
 var getRequestTimeLimit = int64(300)
 
+// the number of rows to fetch at once when streaming
+var streamFetchCount = 1000
+
 // CacheProxy - our interface
 type CacheProxy interface {
-	Exists([]string) (bool, error)
-	Get([]string) ([]awssqs.Message, error)
+	Lookup([]Record) (*LookupResult, error)
+	Get([]Record) ([]awssqs.Message, error)
+	Stream(CacheFilter, func(*awssqs.Message) error) (int, error)
+	Now() (time.Time, error) // the current time according to the cache
 }
 
+// LookupResult - the outcome of looking up a set of records in the cache
+type LookupResult struct {
+	Found   []FoundRecord // the records found in the cache
+	Missing []Record      // the records not found in the cache
+}
+
+// FoundRecord - a record found in the cache and the data source(s) it was found in
+type FoundRecord struct {
+	Record  Record
+	Sources []string
+}
+
+// CacheFilter - selects the cache rows to stream
+type CacheFilter struct {
+	Sources []string // the data sources to include
+	Types   []string // the record types to include, empty for all types
+
+	UpdatedColumn string    // the update timestamp column, required if using a time range
+	Since         time.Time // include rows updated at or after this time, zero for no lower bound
+	Until         time.Time // include rows updated before this time, zero for no upper bound
+}
+
+// a row from the cache table
+type cacheRow struct {
+	ID      string `db:"id" json:"id"`
+	Type    string `db:"type" json:"type"`
+	Source  string `db:"source" json:"source"`
+	Payload string `db:"payload" json:"payload"`
+
+	Encoding string            `db:"encoding" json:"encoding"` // the payload content encoding marker, if configured
+	Extra    map[string]string `db:"-" json:"-"`               // the values of any additional columns, by column name
+
+	Selection int `db:"-" json:"-"` // the index of the history key the row was selected for (history rows only)
+}
+
+// cacheStore - the storage backend behind the cache proxy, all backends share the same id/type/source/payload schema
+type cacheStore interface {
+	lookupRows([]string, []string) ([]cacheRow, error)           // the id and source of rows matching the keys and sources
+	getRows([]string, []string) ([]cacheRow, error)              // the rows matching the keys and sources
+	streamRows(CacheFilter, func([]cacheRow) error) (int, error) // every row matching the filter, in batches
+	historyRows([]historyKey, []string) ([]cacheRow, error)      // the historical rows for the keys, at most one per key per source
+	columns() ([]string, error)                                  // the column names of the cache table
+	now() (time.Time, error)                                     // the current time according to the database clock
+	sourceCounts([]string) (map[string]int, error)               // the number of rows for each of the sources
+}
+
+// the cache backends we support
+var CacheBackendPostgres = "postgres"
+var CacheBackendSqlite = "sqlite"
+var CacheBackendMemory = "memory"
+
 // our implementation
 type cacheProxyImpl struct {
-	tableName   string
 	dataSources []string
-	db          *dbx.DB
+	precedence  string
+	compression PayloadCompression
+	attributes  []AttributeColumn
+	tombstones  Tombstones
+	store       cacheStore
 }
 
 // NewCacheProxy - our factory
@@ -42,97 +114,174 @@ func NewCacheProxy(config *ServiceConfig) (CacheProxy, error) {
 
 	impl := &cacheProxyImpl{}
 
-	connStr := fmt.Sprintf("user=%s password=%s dbname=%s host=%s port=%d connect_timeout=%d",
-		config.PostgresUser, config.PostgresPass, config.PostgresDatabase, config.PostgresHost, config.PostgresPort, 30)
+	var err error
+	switch config.CacheBackend {
+	case CacheBackendPostgres:
+		impl.store, err = newPostgresBackend(config)
+	case CacheBackendSqlite:
+		impl.store, err = newSqliteBackend(config)
+	case CacheBackendMemory:
+		impl.store, err = newMemoryStore(config)
+	default:
+		err = fmt.Errorf("unsupported cache backend [%s]", config.CacheBackend)
+	}
 
-	db, err := dbx.MustOpen("postgres", connStr)
 	if err != nil {
 		return nil, err
 	}
 
-	// uncomment for SQL logging
-	//db.LogFunc = log.Printf
-
-	impl.tableName = config.PostgresTable
 	impl.dataSources = strings.Split(config.DataSourceNames, " ")
-	impl.db = db
+	impl.precedence = config.SourcePrecedence
+	impl.compression = config.PayloadCompression
+	impl.attributes = config.AttributeColumns
+	impl.tombstones = config.Tombstones
+
+	if config.VerifyCacheSchema == true {
+		err = verifyCacheSchema(impl.store, impl.dataSources, config.PostgresUpdatedColumn, config.additionalColumns())
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return impl, nil
 }
 
-// do all of the supplied keys exist in the cache
-func (ci *cacheProxyImpl) Exists(keys []string) (bool, error) {
+// lookup the supplied records in the cache and return those found (and where) and those missing
+func (ci *cacheProxyImpl) Lookup(records []Record) (*LookupResult, error) {
 
-	var ids []struct {
-		ID string `db:"id"`
+	result := &LookupResult{
+		Found:   make([]FoundRecord, 0, len(records)),
+		Missing: make([]Record, 0),
 	}
 
-	q := ci.db.Select("id").
-		From(ci.tableName).
-		Where(dbx.And(dbx.In("id", toInterfaceArray(keys)...), dbx.In("source", toInterfaceArray(ci.dataSources)...)))
-
-	start := time.Now()
-	err := q.All(&ids)
-	elapsed := int64(time.Since(start) / time.Millisecond)
-	ci.warnIfSlow(elapsed, lookupRequestTimeLimit, fmt.Sprintf("CacheExists (%d items)", len(keys)))
+	// historical payloads are looked up in the history table
+	current := make([]Record, 0, len(records))
+	historical := make([]Record, 0)
+	for _, r := range records {
+		if isHistorical(r) == true {
+			historical = append(historical, r)
+		} else {
+			current = append(current, r)
+		}
+	}
 
+	history, err := ci.historyRows(historical)
 	if err != nil {
-		return false, err
+		return nil, err
+	}
+	for ix, r := range historical {
+		if len(history[ix]) == 0 {
+			result.Missing = append(result.Missing, r)
+			continue
+		}
+		found := FoundRecord{Record: r, Sources: make([]string, 0, len(history[ix]))}
+		for _, row := range history[ix] {
+			found.Sources = append(found.Sources, row.Source)
+		}
+		result.Found = append(result.Found, found)
 	}
 
-	//log.Printf("INFO: lookup %d keys in %d milliseconds (%d results)", len( keys ), elapsed, len(ids))
-
-	// verify that we received all ids
-	if len(ids) != len(keys) {
-
-		// locate which key(s) were not located and log as necessary
-		founds := make([]bool, len(keys))
-		for _, id := range ids {
-			ix, found := find(keys, id.ID)
-			if found {
-				founds[ix] = true
-			}
+	groups, sources := ci.groupBySource(current)
+	for _, source := range sources {
+		group := groups[source]
+		found, err := ci.lookupInSources(recordIds(group), ci.lookupSources(source))
+		if err != nil {
+			return nil, err
 		}
 
-		for ix, f := range founds {
-			if f == false {
-				log.Printf("ERROR: id %s does not exist in the cache", keys[ix])
+		for _, r := range group {
+			if s, ok := found[r.Id()]; ok == true {
+				result.Found = append(result.Found, FoundRecord{Record: r, Sources: s})
+			} else {
+				result.Missing = append(result.Missing, r)
 			}
 		}
+	}
+
+	return result, nil
+}
 
-		return false, ErrNotInCache
+// lookup the supplied keys in the cache in the specified sources and return the sources each found key is in
+func (ci *cacheProxyImpl) lookupInSources(keys []string, sources []string) (map[string][]string, error) {
+
+	// the same key may be requested more than once
+	keys = uniqueStrings(keys)
+
+	ids, err := ci.store.lookupRows(keys, sources)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string][]string, len(ids))
+	for _, id := range ids {
+		found[id.ID] = append(found[id.ID], id.Source)
 	}
 
-	// everything OK
-	return true, nil
+	return found, nil
 }
 
 // get the specified items from the cache
-func (ci *cacheProxyImpl) Get(keys []string) ([]awssqs.Message, error) {
+func (ci *cacheProxyImpl) Get(records []Record) ([]awssqs.Message, error) {
 
-	var cacheRecords []struct {
-		ID      string `db:"id"`
-		Type    string `db:"type"`
-		Source  string `db:"source"`
-		Payload string `db:"payload"`
+	// the response
+	messages := make([]awssqs.Message, 0, len(records))
+
+	// deletes do not need the payload (and the record may already be gone from the cache)
+	updates := make([]Record, 0, len(records))
+	historical := make([]Record, 0)
+	for _, r := range records {
+		if r.Operation() == awssqs.AttributeValueRecordOperationDelete {
+			source, err := ci.deleteSource(r)
+			if err != nil {
+				return nil, err
+			}
+			messages = append(messages, *ci.constructMessage(r, "", source, r.Id()))
+		} else if isHistorical(r) == true {
+			historical = append(historical, r)
+		} else {
+			updates = append(updates, r)
+		}
 	}
 
-	q := ci.db.Select("id", "type", "source", "payload").
-		From(ci.tableName).
-		Where(dbx.And(dbx.In("id", toInterfaceArray(keys)...), dbx.In("source", toInterfaceArray(ci.dataSources)...)))
+	if len(historical) != 0 {
+		m, err := ci.getHistorical(historical)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, m...)
+	}
 
-	start := time.Now()
-	err := q.All(&cacheRecords)
-	elapsed := int64(time.Since(start) / time.Millisecond)
-	ci.warnIfSlow(elapsed, getRequestTimeLimit, fmt.Sprintf("CacheGet (%d items)", len(keys)))
+	groups, sources := ci.groupBySource(updates)
+	for _, source := range sources {
+		m, err := ci.getFromSources(groups[source], ci.lookupSources(source))
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, m...)
+	}
 
-	//log.Printf("INFO: get %d keys in %d milliseconds (%d results)", len( keys ), elapsed, len(cacheRecords))
+	return messages, nil
+}
 
+// get the specified items from the cache in one of the specified sources
+func (ci *cacheProxyImpl) getFromSources(records []Record, sources []string) ([]awssqs.Message, error) {
+
+	// the same key may be requested more than once, we only return it once
+	keys := uniqueStrings(recordIds(records))
+
+	cacheRecords, err := ci.store.getRows(keys, sources)
 	if err != nil {
 		return nil, err
 	}
 
+	// group the rows by id, an id may exist in more than one source
+	rows := make(map[string][]cacheRow, len(keys))
+	for _, r := range cacheRecords {
+		rows[r.ID] = append(rows[r.ID], r)
+	}
+
 	// verify that we received all ids
-	if len(cacheRecords) != len(keys) {
+	if len(rows) != len(keys) {
 		log.Printf("ERROR: item not found during cache lookup, this is unexpected")
 		return nil, ErrNotInCache
 	}
@@ -140,62 +289,288 @@ func (ci *cacheProxyImpl) Get(keys []string) ([]awssqs.Message, error) {
 	// the response
 	messages := make([]awssqs.Message, 0, len(keys))
 
-	for _, r := range cacheRecords {
+	for _, key := range keys {
+		for _, r := range ci.selectRows(rows[key], sources) {
+
+			if len(r.ID) == 0 {
+				log.Printf("WARNING: id is empty")
+			}
+
+			if len(r.Type) == 0 {
+				log.Printf("WARNING: type is empty")
+			}
+
+			if len(r.Source) == 0 {
+				log.Printf("WARNING: source is empty")
+			}
+
+			if len(r.Payload) == 0 {
+				log.Printf("WARNING: payload is empty")
+			}
+
+			//log.Printf( "Record %d: ID:         %s", ix, r.ID )
+			//log.Printf( "Record %d: datatype:   %s", ix, r.Type )
+			//log.Printf( "Record %d: datasource: %s", ix, r.Source )
+			//log.Printf( "Record %d: payload:    %s", ix, r.Payload )
 
-		if len(r.ID) == 0 {
-			log.Printf("WARNING: id is empty")
+			rec := findRecord(records, r.ID, r.Source)
+			if rec == nil {
+				log.Printf("ERROR: unexpected id %s returned from the cache", r.ID)
+				return nil, ErrNotInCache
+			}
+
+			message, err := ci.rowMessage(rec, r)
+			if err != nil {
+				return nil, err
+			}
+			messages = append(messages, *message)
 		}
+	}
+
+	return messages, nil
+}
 
-		if len(r.Type) == 0 {
-			log.Printf("WARNING: type is empty")
+// get the historical payloads selected by the records from the cache history
+func (ci *cacheProxyImpl) getHistorical(records []Record) ([]awssqs.Message, error) {
+
+	history, err := ci.historyRows(records)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]awssqs.Message, 0, len(records))
+	for ix, rec := range records {
+
+		if len(history[ix]) == 0 {
+			log.Printf("ERROR: %s of id %s not found in the cache history", historyDescription(rec), rec.Id())
+			return nil, ErrNotInCache
 		}
 
-		if len(r.Source) == 0 {
-			log.Printf("WARNING: source is empty")
+		for _, r := range ci.selectRows(history[ix], ci.lookupSources(rec.Source())) {
+			message, err := ci.rowMessage(rec, r)
+			if err != nil {
+				return nil, err
+			}
+			messages = append(messages, *message)
 		}
+	}
 
-		if len(r.Payload) == 0 {
-			log.Printf("WARNING: payload is empty")
+	return messages, nil
+}
+
+// the history rows selected by each of the records, one query per record source (rather than per record). Returns
+// the rows for each record in record order, empty for a record with no history
+func (ci *cacheProxyImpl) historyRows(records []Record) ([][]cacheRow, error) {
+
+	result := make([][]cacheRow, len(records))
+
+	// group the record indexes by source
+	groups := make(map[string][]int)
+	sources := make([]string, 0, 1)
+	for ix, r := range records {
+		if _, found := groups[r.Source()]; found == false {
+			sources = append(sources, r.Source())
 		}
+		groups[r.Source()] = append(groups[r.Source()], ix)
+	}
 
-		//log.Printf( "Record %d: ID:         %s", ix, r.ID )
-		//log.Printf( "Record %d: datatype:   %s", ix, r.Type )
-		//log.Printf( "Record %d: datasource: %s", ix, r.Source )
-		//log.Printf( "Record %d: payload:    %s", ix, r.Payload )
+	for _, source := range sources {
+		group := groups[source]
+		keys := make([]historyKey, 0, len(group))
+		for _, ix := range group {
+			keys = append(keys, historyKeyFor(records[ix]))
+		}
 
-		messages = append(messages, *ci.constructMessage(r.ID, r.Type, r.Source, r.Payload))
+		rows, err := ci.store.historyRows(keys, ci.lookupSources(source))
+		if err != nil {
+			return nil, err
+		}
+
+		// each row notes the key it was selected for
+		for _, row := range rows {
+			ix := group[row.Selection]
+			result[ix] = append(result[ix], row)
+		}
 	}
 
-	return messages, nil
+	return result, nil
 }
 
-// construct the outbound SQS message
-func (ci *cacheProxyImpl) constructMessage(id string, theType string, source string, payload string) *awssqs.Message {
+// an id can exist in more than one of the lookup sources, select the row(s) to send based on the precedence policy.
+// For the ordered policy, the first source in the lookup order wins
+func (ci *cacheProxyImpl) selectRows(rows []cacheRow, sources []string) []cacheRow {
 
-	attributes := make([]awssqs.Attribute, 0, 4)
-	attributes = append(attributes, awssqs.Attribute{Name: awssqs.AttributeKeyRecordId, Value: id})
-	attributes = append(attributes, awssqs.Attribute{Name: awssqs.AttributeKeyRecordType, Value: theType})
+	if len(rows) < 2 || ci.precedence == SourcePrecedenceAll {
+		return rows
+	}
+
+	best := 0
+	bestIx := len(sources)
+	for ix, r := range rows {
+		for six, source := range sources {
+			if source == r.Source && six < bestIx {
+				best, bestIx = ix, six
+			}
+		}
+	}
+
+	return rows[best : best+1]
+}
+
+// stream every row matching the filter to the sink without holding the result set in memory. Returns the number
+// of rows streamed
+func (ci *cacheProxyImpl) Stream(filter CacheFilter, sink func(*awssqs.Message) error) (int, error) {
+
+	return ci.store.streamRows(filter, func(rows []cacheRow) error {
+		for _, r := range rows {
+			rec := &recordImpl{RecordId: r.ID, RecordSource: r.Source, RecordOperation: awssqs.AttributeValueRecordOperationUpdate}
+			message, err := ci.rowMessage(rec, r)
+			if err != nil {
+				return err
+			}
+			err = sink(message)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// the current time according to the cache, rows are timestamped by the database so this is the clock that matters
+// when selecting by update time
+func (ci *cacheProxyImpl) Now() (time.Time, error) {
+	return ci.store.now()
+}
+
+// group the records by their data source and return the groups and the ordered list of sources. Records without
+// a source are grouped under the empty source
+func (ci *cacheProxyImpl) groupBySource(records []Record) (map[string][]Record, []string) {
+
+	groups := make(map[string][]Record)
+	sources := make([]string, 0, 1)
+	for _, r := range records {
+		source := r.Source()
+		if _, found := groups[source]; found == false {
+			sources = append(sources, source)
+		}
+		groups[source] = append(groups[source], r)
+	}
+
+	return groups, sources
+}
+
+// the sources to lookup for the specified record source, the empty source means all configured sources
+func (ci *cacheProxyImpl) lookupSources(source string) []string {
+
+	if len(source) == 0 {
+		return ci.dataSources
+	}
+	return []string{source}
+}
+
+// the source for a delete, either specified by the record or the only configured source
+func (ci *cacheProxyImpl) deleteSource(rec Record) (string, error) {
+
+	if len(rec.Source()) != 0 {
+		if contains(ci.dataSources, rec.Source()) == false {
+			log.Printf("ERROR: delete for id %s specifies unknown source %s", rec.Id(), rec.Source())
+			return "", ErrUnknownSource
+		}
+		return rec.Source(), nil
+	}
+
+	if len(ci.dataSources) != 1 {
+		log.Printf("ERROR: delete for id %s does not specify a source", rec.Id())
+		return "", ErrAmbiguousSource
+	}
+
+	return ci.dataSources[0], nil
+}
+
+// construct the outbound SQS message. Delete messages use the id as the payload because SQS does not allow an
+// empty message
+func (ci *cacheProxyImpl) constructMessage(rec Record, theType string, source string, payload string) *awssqs.Message {
+
+	attributes := make([]awssqs.Attribute, 0, 6)
+	attributes = append(attributes, awssqs.Attribute{Name: awssqs.AttributeKeyRecordId, Value: rec.Id()})
+	// deletes do not have a type
+	if len(theType) != 0 {
+		attributes = append(attributes, awssqs.Attribute{Name: awssqs.AttributeKeyRecordType, Value: theType})
+	}
 	attributes = append(attributes, awssqs.Attribute{Name: awssqs.AttributeKeyRecordSource, Value: source})
-	attributes = append(attributes, awssqs.Attribute{Name: awssqs.AttributeKeyRecordOperation, Value: awssqs.AttributeValueRecordOperationUpdate})
+	attributes = append(attributes, awssqs.Attribute{Name: awssqs.AttributeKeyRecordOperation, Value: rec.Operation()})
+	if rec.Priority() != 0 {
+		attributes = append(attributes, awssqs.Attribute{Name: attributeKeyRecordPriority, Value: strconv.Itoa(rec.Priority())})
+	}
+	if len(rec.Note()) != 0 {
+		attributes = append(attributes, awssqs.Attribute{Name: attributeKeyRecordNote, Value: rec.Note()})
+	}
 	return &awssqs.Message{Attribs: attributes, Payload: []byte(payload)}
 }
 
+// construct the outbound SQS message for a cache row, handling any compressed payload and additional attributes.
+// Tombstones (withdrawn records) become deletes
+func (ci *cacheProxyImpl) rowMessage(rec Record, r cacheRow) (*awssqs.Message, error) {
+
+	if ci.tombstones.IsTombstone(r) == true {
+		deleted := &recordImpl{RecordId: rec.Id(), RecordSource: r.Source, RecordOperation: awssqs.AttributeValueRecordOperationDelete,
+			RecordPriority: rec.Priority(), RecordNote: rec.Note(), RecordLine: rec.Line()}
+		message := ci.constructMessage(deleted, "", r.Source, r.ID)
+		addColumnAttributes(message, ci.attributes, r.Extra)
+		return message, nil
+	}
+
+	payload, attributes, err := ci.compression.decode(r.Source, r.Payload, r.Encoding)
+	if err != nil {
+		log.Printf("ERROR: id %s from %s: %s", r.ID, r.Source, err.Error())
+		return nil, err
+	}
+
+	message := ci.constructMessage(rec, r.Type, r.Source, payload)
+	message.Attribs = append(message.Attribs, attributes...)
+	addColumnAttributes(message, ci.attributes, r.Extra)
+	return message, nil
+}
+
 // sometimes it is interesting to know if our SQS queries are slow
-func (ci *cacheProxyImpl) warnIfSlow(elapsed int64, limit int64, prefix string) {
+func warnIfSlow(elapsed int64, limit int64, prefix string) {
 
 	if elapsed > limit {
 		log.Printf("INFO: %s elapsed %d ms", prefix, elapsed)
 	}
 }
 
-// simplified hack
-func find(slice []string, value string) (int, bool) {
-	for ix, item := range slice {
-		if item == value {
-			return ix, true
+// locate the record with the specified id that was looked up in the specified source
+func findRecord(records []Record, id string, source string) Record {
+	for _, r := range records {
+		if r.Id() == id && (len(r.Source()) == 0 || r.Source() == source) {
+			return r
+		}
+	}
+	return nil
+}
+
+// the ids of the supplied records
+func recordIds(records []Record) []string {
+	ids := make([]string, 0, len(records))
+	for _, r := range records {
+		ids = append(ids, r.Id())
+	}
+	return ids
+}
+
+// remove duplicates preserving order
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	unique := make([]string, 0, len(values))
+	for _, v := range values {
+		if seen[v] == false {
+			seen[v] = true
+			unique = append(unique, v)
 		}
 	}
-	return -1, false
+	return unique
 }
 
 func toInterfaceArray(strings []string) []interface{} {
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// the cache rows most of the tests use, id u1 exists in both sources
+var testCacheRows = []string{
+	`{"id":"u1","type":"xml","source":"first","payload":"first u1"}`,
+	`{"id":"u1","type":"xml","source":"second","payload":"second u1"}`,
+	`{"id":"u2","type":"xml","source":"second","payload":"second u2"}`,
+	`{"id":"u3","type":"xml","source":"first","payload":"first u3","status":"withdrawn"}`,
+}
+
+func TestCacheProxyLookup(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		records []Record
+		found   []string // id:source,source
+		missing []string
+	}{
+		{
+			name:    "any source",
+			records: []Record{testUpdate("u1", ""), testUpdate("u2", "")},
+			found:   []string{"u1:first,second", "u2:second"},
+		},
+		{
+			name:    "specified source",
+			records: []Record{testUpdate("u1", "second"), testUpdate("u2", "first")},
+			found:   []string{"u1:second"},
+			missing: []string{"u2"},
+		},
+		{
+			name:    "missing id",
+			records: []Record{testUpdate("u9", ""), testUpdate("u3", "")},
+			found:   []string{"u3:first"},
+			missing: []string{"u9"},
+		},
+		{
+			name:    "repeated id",
+			records: []Record{testUpdate("u2", ""), testUpdate("u2", "")},
+			found:   []string{"u2:second", "u2:second"},
+		},
+	}
+
+	ci := newTestCacheProxy(t, SourcePrecedenceOrdered, nil)
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := ci.Lookup(tc.records)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			found := make([]string, 0, len(result.Found))
+			for _, f := range result.Found {
+				found = append(found, f.Record.Id()+":"+strings.Join(f.Sources, ","))
+			}
+			missing := make([]string, 0, len(result.Missing))
+			for _, r := range result.Missing {
+				missing = append(missing, r.Id())
+			}
+			expectStrings(t, "found", found, tc.found)
+			expectStrings(t, "missing", missing, tc.missing)
+		})
+	}
+}
+
+func TestCacheProxyGet(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		precedence string
+		records    []Record
+		want       []string // id/source/operation/payload
+	}{
+		{
+			name:       "single source",
+			precedence: SourcePrecedenceOrdered,
+			records:    []Record{testUpdate("u2", "")},
+			want:       []string{"u2/second/update/second u2"},
+		},
+		{
+			name:       "ordered precedence uses the first source",
+			precedence: SourcePrecedenceOrdered,
+			records:    []Record{testUpdate("u1", "")},
+			want:       []string{"u1/first/update/first u1"},
+		},
+		{
+			name:       "all precedence uses every source",
+			precedence: SourcePrecedenceAll,
+			records:    []Record{testUpdate("u1", "")},
+			want:       []string{"u1/first/update/first u1", "u1/second/update/second u1"},
+		},
+		{
+			name:       "specified source overrides precedence",
+			precedence: SourcePrecedenceOrdered,
+			records:    []Record{testUpdate("u1", "second")},
+			want:       []string{"u1/second/update/second u1"},
+		},
+		{
+			name:       "repeated id is sent once",
+			precedence: SourcePrecedenceOrdered,
+			records:    []Record{testUpdate("u2", ""), testUpdate("u2", "")},
+			want:       []string{"u2/second/update/second u2"},
+		},
+		{
+			name:       "tombstone becomes a delete",
+			precedence: SourcePrecedenceOrdered,
+			records:    []Record{testUpdate("u3", "")},
+			want:       []string{"u3/first/delete/u3"},
+		},
+		{
+			name:       "delete does not need the cache",
+			precedence: SourcePrecedenceOrdered,
+			records:    []Record{testDelete("u9", "second")},
+			want:       []string{"u9/second/delete/u9"},
+		},
+	}
+
+	tombstones := Tombstones{{Column: "status", Value: "withdrawn"}}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ci := newTestCacheProxy(t, tc.precedence, tombstones)
+			messages, err := ci.Get(tc.records)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectStrings(t, "messages", describeMessages(messages), tc.want)
+		})
+	}
+}
+
+func TestCacheProxyGetErrors(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		records []Record
+		want    error
+	}{
+		{name: "missing id", records: []Record{testUpdate("u9", "")}, want: ErrNotInCache},
+		{name: "missing from the specified source", records: []Record{testUpdate("u2", "first")}, want: ErrNotInCache},
+		{name: "delete without a source", records: []Record{testDelete("u1", "")}, want: ErrAmbiguousSource},
+		{name: "delete from an unknown source", records: []Record{testDelete("u1", "third")}, want: ErrUnknownSource},
+		{name: "history is not available", records: []Record{testVersion("u1", "first", 1)}, want: ErrNoHistory},
+	}
+
+	ci := newTestCacheProxy(t, SourcePrecedenceOrdered, nil)
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ci.Get(tc.records)
+			if errors.Is(err, tc.want) == false {
+				t.Errorf("got %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+// the memory backend has no history so these use sqlite
+func TestCacheProxyHistory(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		records []Record
+		want    []string // id/source/operation/payload, empty if the lookup should find nothing
+	}{
+		{
+			name:    "by version",
+			records: []Record{testVersion("u1", "first", 1), testVersion("u1", "second", 2)},
+			want:    []string{"u1/first/update/first v1", "u1/second/update/second v2"},
+		},
+		{
+			name:    "by time",
+			records: []Record{testAsOf("u1", "first", "2024-01-02T00:00:00Z"), testAsOf("u1", "second", "2024-01-03T00:00:00Z")},
+			want:    []string{"u1/first/update/first v1", "u1/second/update/second v2"},
+		},
+		{
+			name:    "by time uses the precedence",
+			records: []Record{testAsOf("u1", "", "2024-06-01T00:00:00Z")},
+			want:    []string{"u1/first/update/first v2"},
+		},
+		{
+			name:    "same id and source selected twice",
+			records: []Record{testVersion("u1", "first", 1), testVersion("u1", "first", 2)},
+			want:    []string{"u1/first/update/first v1", "u1/first/update/first v2"},
+		},
+		{
+			name:    "missing version",
+			records: []Record{testVersion("u1", "first", 9)},
+		},
+		{
+			name:    "before the first version",
+			records: []Record{testAsOf("u1", "first", "2023-01-01T00:00:00Z")},
+		},
+	}
+
+	ci := newTestHistoryProxy(t)
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := ci.Lookup(tc.records)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tc.want) == 0 {
+				if len(result.Missing) == 0 {
+					t.Errorf("expected missing records")
+				}
+				return
+			}
+			if len(result.Missing) != 0 {
+				t.Fatalf("unexpected missing records")
+			}
+
+			messages, err := ci.Get(tc.records)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectStrings(t, "messages", describeMessages(messages), tc.want)
+		})
+	}
+}
+
+// a proxy over a memory backend holding the test rows, configured with two sources
+func newTestCacheProxy(t *testing.T, precedence string, tombstones Tombstones) CacheProxy {
+
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "cache.jsonl")
+	err := os.WriteFile(file, []byte(strings.Join(testCacheRows, "\n")), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ServiceConfig{CacheBackend: CacheBackendMemory, MemoryFile: file, DataSourceNames: "first second",
+		SourcePrecedence: precedence, Tombstones: tombstones, VerifyCacheSchema: true}
+	ci, err := NewCacheProxy(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ci
+}
+
+// a proxy over a sqlite backend with history, u1 has two versions in each source
+func newTestHistoryProxy(t *testing.T) CacheProxy {
+
+	t.Helper()
+	config := &ServiceConfig{CacheBackend: CacheBackendSqlite, SqliteFile: filepath.Join(t.TempDir(), "cache.db"),
+		SqliteTable: "cache", DataSourceNames: "first second", SourcePrecedence: SourcePrecedenceOrdered,
+		HistoryTable: "history", HistoryVersionColumn: "version", HistoryTimeColumn: "updated_at", VerifyCacheSchema: true}
+
+	db, err := openSqlite(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	statements := []string{
+		"CREATE TABLE cache (id text, type text, source text, payload text)",
+		"INSERT INTO cache VALUES ('u1', 'xml', 'first', 'first u1'), ('u1', 'xml', 'second', 'second u1')",
+		"CREATE TABLE history (id text, type text, source text, payload text, version integer, updated_at text)",
+		"INSERT INTO history VALUES ('u1', 'xml', 'first', 'first v1', 1, '2024-01-01T00:00:00Z'), " +
+			"('u1', 'xml', 'first', 'first v2', 2, '2024-02-01T00:00:00Z'), " +
+			"('u1', 'xml', 'second', 'second v1', 1, '2024-01-01T00:00:00Z'), " +
+			"('u1', 'xml', 'second', 'second v2', 2, '2024-01-02T00:00:00Z')",
+	}
+	for _, statement := range statements {
+		if _, err = db.NewQuery(statement).Execute(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ci, err := NewCacheProxy(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ci
+}
+
+func testUpdate(id string, source string) Record {
+	return &recordImpl{RecordId: id, RecordSource: source, RecordOperation: awssqs.AttributeValueRecordOperationUpdate}
+}
+
+func testDelete(id string, source string) Record {
+	return &recordImpl{RecordId: id, RecordSource: source, RecordOperation: awssqs.AttributeValueRecordOperationDelete}
+}
+
+func testVersion(id string, source string, version int) Record {
+	return &recordImpl{RecordId: id, RecordSource: source, RecordOperation: awssqs.AttributeValueRecordOperationUpdate,
+		RecordVersion: version}
+}
+
+func testAsOf(id string, source string, asOf string) Record {
+	tm, _ := time.Parse(time.RFC3339, asOf)
+	return &recordImpl{RecordId: id, RecordSource: source, RecordOperation: awssqs.AttributeValueRecordOperationUpdate,
+		RecordAsOf: tm}
+}
+
+// describe each message as id/source/operation/payload
+func describeMessages(messages []awssqs.Message) []string {
+
+	result := make([]string, 0, len(messages))
+	for _, m := range messages {
+		values := make(map[string]string)
+		for _, a := range m.Attribs {
+			values[a.Name] = a.Value
+		}
+		result = append(result, values[awssqs.AttributeKeyRecordId]+"/"+values[awssqs.AttributeKeyRecordSource]+"/"+
+			values[awssqs.AttributeKeyRecordOperation]+"/"+string(m.Payload))
+	}
+	return result
+}
+
+// compare ignoring order
+func expectStrings(t *testing.T, what string, got []string, want []string) {
+
+	t.Helper()
+	got = append([]string{}, got...)
+	want = append([]string{}, want...)
+	sort.Strings(got)
+	sort.Strings(want)
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("%s: got %v, want %v", what, got, want)
+	}
+}
+
+//
+// end of file
+//
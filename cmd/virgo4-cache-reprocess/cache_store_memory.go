@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// a row in the memory backend, the cache schema plus the update time used by incremental jobs
+type memoryRow struct {
+	cacheRow
+	Updated time.Time `json:"updated_at"`
+}
+
+// the memory backend, useful for local development and testing. Rows are kept in load order
+type memoryStore struct {
+	rows         []memoryRow
+	index        map[string][]int // id to row indexes
+	extraColumns []string         // additional columns sent as message attributes
+}
+
+// create a memory backend, loading it from a JSON lines file of rows if one is configured
+func newMemoryStore(config *ServiceConfig) (cacheStore, error) {
+
+	ms := &memoryStore{rows: make([]memoryRow, 0), index: make(map[string][]int),
+		extraColumns: config.extraColumns()}
+	if len(config.MemoryFile) == 0 {
+		return ms, nil
+	}
+
+	file, err := os.Open(config.MemoryFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	// payloads can be large
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+
+		var r memoryRow
+		err = json.Unmarshal([]byte(line), &r)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %s", config.MemoryFile, lineNo, err.Error())
+		}
+		r.Extra, err = ms.extraValues([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %s", config.MemoryFile, lineNo, err.Error())
+		}
+		ms.add(r)
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	log.Printf("INFO: loaded %d rows from %s", len(ms.rows), config.MemoryFile)
+	return ms, nil
+}
+
+// the values of the additional columns, strings are used as is and anything else as its JSON text
+func (ms *memoryStore) extraValues(line []byte) (map[string]string, error) {
+
+	if len(ms.extraColumns) == 0 {
+		return nil, nil
+	}
+
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(line, &fields)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string, len(ms.extraColumns))
+	for _, c := range ms.extraColumns {
+		raw, found := fields[c]
+		value := ""
+		if found == true && string(raw) != "null" {
+			if json.Unmarshal(raw, &value) != nil {
+				value = string(raw)
+			}
+		}
+		values[c] = value
+	}
+	return values, nil
+}
+
+func (ms *memoryStore) add(r memoryRow) {
+	ms.index[r.ID] = append(ms.index[r.ID], len(ms.rows))
+	ms.rows = append(ms.rows, r)
+}
+
+func (ms *memoryStore) lookupRows(keys []string, sources []string) ([]cacheRow, error) {
+
+	rows, err := ms.getRows(keys, sources)
+	if err != nil {
+		return nil, err
+	}
+
+	// lookups only return the id and source
+	for ix := range rows {
+		rows[ix].Type = ""
+		rows[ix].Payload = ""
+		rows[ix].Extra = nil
+	}
+	return rows, nil
+}
+
+func (ms *memoryStore) getRows(keys []string, sources []string) ([]cacheRow, error) {
+
+	rows := make([]cacheRow, 0, len(keys))
+	for _, key := range keys {
+		for _, ix := range ms.index[key] {
+			if contains(sources, ms.rows[ix].Source) {
+				rows = append(rows, ms.rows[ix].cacheRow)
+			}
+		}
+	}
+	return rows, nil
+}
+
+func (ms *memoryStore) streamRows(filter CacheFilter, handler func([]cacheRow) error) (int, error) {
+
+	count := 0
+	batch := make([]cacheRow, 0, streamFetchCount)
+	for _, r := range ms.rows {
+		if ms.matches(r, filter) == false {
+			continue
+		}
+
+		batch = append(batch, r.cacheRow)
+		if len(batch) == streamFetchCount {
+			if err := handler(batch); err != nil {
+				return count, err
+			}
+			count += len(batch)
+			batch = batch[:0]
+		}
+	}
+
+	if len(batch) != 0 {
+		if err := handler(batch); err != nil {
+			return count, err
+		}
+		count += len(batch)
+	}
+
+	return count, nil
+}
+
+// does the row match the filter. The memory backend only knows about a single update time
+func (ms *memoryStore) matches(r memoryRow, filter CacheFilter) bool {
+
+	if contains(filter.Sources, r.Source) == false {
+		return false
+	}
+	if len(filter.Types) != 0 && contains(filter.Types, r.Type) == false {
+		return false
+	}
+	if filter.Since.IsZero() == false && r.Updated.Before(filter.Since) {
+		return false
+	}
+	if filter.Until.IsZero() == false && r.Updated.Before(filter.Until) == false {
+		return false
+	}
+	return true
+}
+
+// the memory backend does not keep history
+func (ms *memoryStore) historyRows(keys []historyKey, sources []string) ([]cacheRow, error) {
+	return nil, ErrNoHistory
+}
+
+// the memory backend is stamped with our own clock
+func (ms *memoryStore) now() (time.Time, error) {
+	return time.Now(), nil
+}
+
+// the memory backend always has the full schema, missing values are empty
+func (ms *memoryStore) columns() ([]string, error) {
+	return append([]string{"id", "type", "source", "payload", "encoding", "updated_at"}, ms.extraColumns...), nil
+}
+
+func (ms *memoryStore) sourceCounts(sources []string) (map[string]int, error) {
+
+	counts := make(map[string]int, len(sources))
+	for _, r := range ms.rows {
+		if contains(sources, r.Source) {
+			counts[r.Source]++
+		}
+	}
+	return counts, nil
+}
+
+//
+// end of file
+//
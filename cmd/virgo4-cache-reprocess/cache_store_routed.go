@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+)
+
+// ErrBadSourceRoute - the per source table or database configuration is invalid
+var ErrBadSourceRoute = fmt.Errorf("bad source route configuration")
+
+// ParseSourceRoutes - parse a space separated list of source=name entries, used to place data sources in their own
+// table or database
+func ParseSourceRoutes(spec string) (map[string]string, error) {
+
+	entries, err := parseKeyValueSpec(spec, ErrBadSourceRoute, "source=name", false)
+	if err != nil {
+		return nil, err
+	}
+
+	routes := make(map[string]string)
+	for _, entry := range entries {
+		if _, found := routes[entry.key]; found == true {
+			return nil, fmt.Errorf("%w: source [%s] is specified more than once", ErrBadSourceRoute, entry.key)
+		}
+		routes[entry.key] = entry.value
+	}
+
+	return routes, nil
+}
+
+// a store that sends each request to the store(s) holding the requested data sources so sources living in separate
+// tables or databases still look like one cache
+type routedStore struct {
+	routes   map[string]cacheStore // the store for each routed source
+	fallback cacheStore            // the store for any other source, nil if the default location is not used
+	stores   []cacheStore          // every distinct store
+}
+
+// a group of sources held by the same store
+type storeSources struct {
+	store   cacheStore
+	sources []string
+}
+
+// create the postgres backend, opening one connection pool per database and one store per table
+func newPostgresBackend(config *ServiceConfig) (cacheStore, error) {
+
+	pools := make(map[string]*dbx.DB)
+	open := func(source string) (cacheStore, error) {
+		database := routeFor(config.PostgresSourceDatabases, source, config.PostgresDatabase)
+		db, found := pools[database]
+		if found == false {
+			var err error
+			db, err = openPostgres(config, database)
+			if err != nil {
+				return nil, fmt.Errorf("database %s: %s", database, err.Error())
+			}
+			pools[database] = db
+		}
+		return newPostgresStore(config, db, routeFor(config.SourceTables, source, config.PostgresTable)), nil
+	}
+
+	store, err := newRoutedStore(config, open, func(source string) string {
+		return routeFor(config.PostgresSourceDatabases, source, config.PostgresDatabase) + "/" +
+			routeFor(config.SourceTables, source, config.PostgresTable)
+	})
+	if err != nil {
+		for _, db := range pools {
+			db.Close()
+		}
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// create the sqlite backend, one store per table
+func newSqliteBackend(config *ServiceConfig) (cacheStore, error) {
+
+	db, err := openSqlite(config)
+	if err != nil {
+		return nil, err
+	}
+
+	open := func(source string) (cacheStore, error) {
+		return newSqliteStore(config, db, routeFor(config.SourceTables, source, config.SqliteTable)), nil
+	}
+
+	return newRoutedStore(config, open, func(source string) string {
+		return routeFor(config.SourceTables, source, config.SqliteTable)
+	})
+}
+
+// create the store for each data source, sources with the same location share a store. The fallback (the default
+// location) is only opened if one of the sources lives there. If everything lives in one place the store is returned
+// as is
+func newRoutedStore(config *ServiceConfig, open func(string) (cacheStore, error), location func(string) string) (cacheStore, error) {
+
+	byLocation := make(map[string]cacheStore)
+	rs := &routedStore{routes: make(map[string]cacheStore), stores: make([]cacheStore, 0, 1)}
+	for _, source := range strings.Fields(config.DataSourceNames) {
+		loc := location(source)
+		store, found := byLocation[loc]
+		if found == false {
+			var err error
+			store, err = open(source)
+			if err != nil {
+				return nil, err
+			}
+			byLocation[loc] = store
+			rs.stores = append(rs.stores, store)
+		}
+		rs.routes[source] = store
+	}
+
+	if len(rs.stores) == 0 {
+		return nil, fmt.Errorf("%w: no data sources are configured", ErrBadSourceRoute)
+	}
+	if len(rs.stores) == 1 {
+		return rs.stores[0], nil
+	}
+
+	// nil if none of the sources live in the default location
+	rs.fallback = byLocation[location("")]
+	return rs, nil
+}
+
+func (rs *routedStore) lookupRows(keys []string, sources []string) ([]cacheRow, error) {
+	return rs.eachGroup(sources, func(store cacheStore, sources []string) ([]cacheRow, error) {
+		return store.lookupRows(keys, sources)
+	})
+}
+
+func (rs *routedStore) getRows(keys []string, sources []string) ([]cacheRow, error) {
+	return rs.eachGroup(sources, func(store cacheStore, sources []string) ([]cacheRow, error) {
+		return store.getRows(keys, sources)
+	})
+}
+
+func (rs *routedStore) historyRows(keys []historyKey, sources []string) ([]cacheRow, error) {
+	return rs.eachGroup(sources, func(store cacheStore, sources []string) ([]cacheRow, error) {
+		return store.historyRows(keys, sources)
+	})
+}
+
+// stream from each store in turn
+func (rs *routedStore) streamRows(filter CacheFilter, handler func([]cacheRow) error) (int, error) {
+
+	total := 0
+	for _, group := range rs.group(filter.Sources) {
+		f := filter
+		f.Sources = group.sources
+		count, err := group.store.streamRows(f, handler)
+		total += count
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
+
+// the earliest of the store clocks, so a time range ending there is complete in every store
+func (rs *routedStore) now() (time.Time, error) {
+
+	var result time.Time
+	for _, store := range rs.stores {
+		now, err := store.now()
+		if err != nil {
+			return time.Time{}, err
+		}
+		if result.IsZero() == true || now.Before(result) == true {
+			result = now
+		}
+	}
+
+	return result, nil
+}
+
+// the columns every store has, so a column missing from any of the tables is reported
+func (rs *routedStore) columns() ([]string, error) {
+
+	var result []string
+	for ix, store := range rs.stores {
+		columns, err := store.columns()
+		if err != nil {
+			return nil, err
+		}
+		if ix == 0 {
+			result = columns
+			continue
+		}
+
+		common := make([]string, 0, len(result))
+		for _, c := range result {
+			for _, other := range columns {
+				if strings.EqualFold(c, other) == true {
+					common = append(common, c)
+					break
+				}
+			}
+		}
+		result = common
+	}
+
+	return result, nil
+}
+
+func (rs *routedStore) sourceCounts(sources []string) (map[string]int, error) {
+
+	result := make(map[string]int, len(sources))
+	for _, group := range rs.group(sources) {
+		counts, err := group.store.sourceCounts(group.sources)
+		if err != nil {
+			return nil, err
+		}
+		for source, count := range counts {
+			result[source] = count
+		}
+	}
+
+	return result, nil
+}
+
+// group the sources by the store that holds them, in the order each store is first needed. A source that is not
+// configured has no store unless the fallback is in use
+func (rs *routedStore) group(sources []string) []storeSources {
+
+	groups := make([]storeSources, 0, 1)
+	for _, source := range sources {
+		store, found := rs.routes[source]
+		if found == false {
+			store = rs.fallback
+		}
+		if store == nil {
+			continue
+		}
+
+		ix := 0
+		for ix < len(groups) && groups[ix].store != store {
+			ix++
+		}
+		if ix == len(groups) {
+			groups = append(groups, storeSources{store: store})
+		}
+		groups[ix].sources = append(groups[ix].sources, source)
+	}
+
+	return groups
+}
+
+// make the request of each store holding some of the sources and combine the rows
+func (rs *routedStore) eachGroup(sources []string, request func(cacheStore, []string) ([]cacheRow, error)) ([]cacheRow, error) {
+
+	result := make([]cacheRow, 0)
+	for _, group := range rs.group(sources) {
+		rows, err := request(group.store, group.sources)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, rows...)
+	}
+
+	return result, nil
+}
+
+// the route for the source if it has one, the default if not
+func routeFor(routes map[string]string, source string, defaultValue string) string {
+
+	if route, found := routes[source]; found == true {
+		return route
+	}
+	return defaultValue
+}
+
+//
+// end of file
+//
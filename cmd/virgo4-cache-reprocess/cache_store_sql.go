@@ -0,0 +1,729 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+// the SQL backends (postgres and sqlite) both use ozzo-dbx
+type sqlStore struct {
+	tableName string
+	cursor    bool // stream using a server side cursor (postgres only)
+	db        *dbx.DB
+
+	historyTable   string   // the history table, empty if there is not one
+	versionColumn  string   // the history version column
+	timeColumn     string   // and the history time column
+	encodingColumn string   // the payload content encoding column, empty if there is not one
+	extraColumns   []string // additional columns sent as message attributes
+
+	lookupStrategy   string // how we select rows by key
+	tempTableMinKeys int    // the smallest batch that uses a temp table (temp table strategy only)
+
+	queryTimeout time.Duration // the deadline for each query, zero for none
+	retries      int           // the number of times a query failing with a transient error is retried
+	retryBackoff time.Duration // the initial delay between retries, doubled each time
+}
+
+// the strategies for selecting rows by key
+var LookupStrategyIn = "in"
+var LookupStrategyAny = "any"
+var LookupStrategyTempTable = "temp"
+
+func init() {
+	// the pure go sqlite driver registers itself as "sqlite" rather than "sqlite3" so tell dbx about it
+	dbx.BuilderFuncMap["sqlite"] = dbx.NewSqliteBuilder
+}
+
+// open a connection pool to the specified postgres database
+func openPostgres(config *ServiceConfig, database string) (*dbx.DB, error) {
+
+	// the connector builds the connection string for each new connection so rotated credentials are picked up
+	connector, err := newPostgresConnector(config, database)
+	if err != nil {
+		return nil, err
+	}
+
+	db := dbx.NewFromDB(sql.OpenDB(connector), "postgres")
+	err = db.DB().Ping()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// tune the connection pool, zero values leave the database/sql defaults in place
+	db.DB().SetMaxOpenConns(config.PostgresMaxOpenConns)
+	if config.PostgresMaxIdleConns != 0 {
+		db.DB().SetMaxIdleConns(config.PostgresMaxIdleConns)
+	}
+	db.DB().SetConnMaxLifetime(time.Duration(config.PostgresConnMaxLifetime) * time.Second)
+	db.DB().SetConnMaxIdleTime(time.Duration(config.PostgresConnMaxIdleTime) * time.Second)
+
+	// uncomment for SQL logging
+	//db.LogFunc = log.Printf
+
+	return db, nil
+}
+
+// a store for the specified table using an open postgres connection pool
+func newPostgresStore(config *ServiceConfig, db *dbx.DB, table string) *sqlStore {
+
+	return &sqlStore{tableName: table, cursor: true, db: db, encodingColumn: config.PayloadEncodingColumn,
+		historyTable: config.HistoryTable, versionColumn: config.HistoryVersionColumn, timeColumn: config.HistoryTimeColumn,
+		extraColumns:   config.extraColumns(),
+		lookupStrategy: config.PostgresLookupStrategy, tempTableMinKeys: config.PostgresTempMinKeys,
+		queryTimeout: time.Duration(config.PostgresQueryTimeout) * time.Second, retries: config.PostgresRetries,
+		retryBackoff: time.Duration(config.PostgresRetryBackoff) * time.Millisecond}
+}
+
+// open the sqlite database
+func openSqlite(config *ServiceConfig) (*dbx.DB, error) {
+
+	db, err := dbx.MustOpen("sqlite", config.SqliteFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// uncomment for SQL logging
+	//db.LogFunc = log.Printf
+
+	return db, nil
+}
+
+// a store for the specified table in the sqlite database
+func newSqliteStore(config *ServiceConfig, db *dbx.DB, table string) *sqlStore {
+
+	// sqlite does not support array parameters
+	return &sqlStore{tableName: table, cursor: false, db: db, encodingColumn: config.PayloadEncodingColumn,
+		historyTable: config.HistoryTable, versionColumn: config.HistoryVersionColumn, timeColumn: config.HistoryTimeColumn,
+		extraColumns:   config.extraColumns(),
+		lookupStrategy: LookupStrategyIn}
+}
+
+func (ss *sqlStore) lookupRows(keys []string, sources []string) ([]cacheRow, error) {
+	return ss.selectRows([]string{"id", "source"}, keys, sources, lookupRequestTimeLimit, "CacheLookup")
+}
+
+func (ss *sqlStore) getRows(keys []string, sources []string) ([]cacheRow, error) {
+	return ss.selectRows(ss.payloadColumns(), keys, sources, getRequestTimeLimit, "CacheGet")
+}
+
+// additional columns are selected using these names so they cannot clash with the standard ones
+var extraColumnPrefix = "extra:"
+
+// the columns needed to construct a message, including the content encoding and additional columns if we have them
+func (ss *sqlStore) payloadColumns() []string {
+
+	columns := []string{"id", "type", "source", "payload"}
+	if len(ss.encodingColumn) != 0 {
+		columns = append(columns, "encoding")
+	}
+	for _, c := range ss.extraColumns {
+		columns = append(columns, extraColumnPrefix+c)
+	}
+	return columns
+}
+
+// the select expression for the named column, the optional table alias is applied if specified. The content
+// encoding is selected from the configured column and may be null
+func (ss *sqlStore) selectExpr(column string, alias string) string {
+
+	prefix := ""
+	if len(alias) != 0 {
+		prefix = alias + "."
+	}
+
+	if column == "encoding" {
+		return fmt.Sprintf("COALESCE(%s%s, '') AS encoding", prefix, ss.db.QuoteColumnName(ss.encodingColumn))
+	}
+	return prefix + ss.db.QuoteColumnName(strings.TrimPrefix(column, extraColumnPrefix))
+}
+
+// the select expressions for the named columns
+func (ss *sqlStore) selectExprs(columns []string, alias string) []string {
+
+	exprs := make([]string, 0, len(columns))
+	for _, c := range columns {
+		exprs = append(exprs, ss.selectExpr(c, alias))
+	}
+	return exprs
+}
+
+// select the rows matching the keys and sources using the configured lookup strategy
+func (ss *sqlStore) selectRows(columns []string, keys []string, sources []string, limit int64, label string) ([]cacheRow, error) {
+
+	strategy := ss.lookupStrategy
+	if strategy == LookupStrategyTempTable && len(keys) < ss.tempTableMinKeys {
+		// small batches are not worth the overhead of a temp table. Gets are at most getCacheMaxKeyCount keys so
+		// a minimum above that means only lookups use the temp table
+		strategy = LookupStrategyAny
+	}
+
+	var rows []cacheRow
+
+	start := time.Now()
+	err := ss.withRetry(label, func(ctx context.Context) error {
+		var err error
+		switch strategy {
+		case LookupStrategyAny:
+			rows, err = ss.selectAny(ctx, columns, keys, sources)
+		case LookupStrategyTempTable:
+			rows, err = ss.selectTempTable(ctx, columns, keys, sources)
+		default:
+			rows, err = ss.selectIn(ctx, columns, keys, sources)
+		}
+		return err
+	})
+	elapsed := int64(time.Since(start) / time.Millisecond)
+	warnIfSlow(elapsed, limit, fmt.Sprintf("%s/%s (%d items)", label, strategy, len(keys)))
+
+	//log.Printf("INFO: %s/%s %d keys in %d milliseconds (%d results)", label, strategy, len(keys), elapsed, len(rows))
+
+	return rows, err
+}
+
+// one bound parameter per key, the query text (and so the plan) changes with the number of keys
+func (ss *sqlStore) selectIn(ctx context.Context, columns []string, keys []string, sources []string) ([]cacheRow, error) {
+
+	q := ss.db.Select(ss.selectExprs(columns, "")...).
+		From(ss.tableName).
+		Where(dbx.And(dbx.In("id", toInterfaceArray(keys)...), dbx.In("source", toInterfaceArray(sources)...)))
+
+	rows, err := q.WithContext(ctx).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanCacheRows(rows.Rows, columns)
+}
+
+// the keys are bound as a single array parameter so the query text is the same for every batch (postgres only)
+func (ss *sqlStore) selectAny(ctx context.Context, columns []string, keys []string, sources []string) ([]cacheRow, error) {
+
+	q := ss.db.Select(ss.selectExprs(columns, "")...).
+		From(ss.tableName).
+		Where(dbx.NewExp("{{id}} = ANY({:ids}) AND {{source}} = ANY({:sources})",
+			dbx.Params{"ids": pq.Array(keys), "sources": pq.Array(sources)}))
+
+	rows, err := q.WithContext(ctx).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanCacheRows(rows.Rows, columns)
+}
+
+// the keys are copied into a temp table which is joined against the cache table, best for very large batches
+// (postgres only)
+func (ss *sqlStore) selectTempTable(ctx context.Context, columns []string, keys []string, sources []string) ([]cacheRow, error) {
+
+	// the temp table only exists for the duration of the transaction
+	tx, err := ss.db.DB().BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	// this is a read only transaction so always rolling back is fine
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "CREATE TEMP TABLE lookup_keys (id text) ON COMMIT DROP")
+	if err != nil {
+		return nil, err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("lookup_keys", "id"))
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		_, err = stmt.Exec(key)
+		if err != nil {
+			stmt.Close()
+			return nil, err
+		}
+	}
+	// flush the copy
+	_, err = stmt.Exec()
+	if err != nil {
+		stmt.Close()
+		return nil, err
+	}
+	err = stmt.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	quoted := ss.selectExprs(columns, "c")
+	query := fmt.Sprintf("SELECT %s FROM %s c JOIN lookup_keys k ON c.id = k.id WHERE c.source = ANY($1)",
+		strings.Join(quoted, ", "), ss.db.QuoteTableName(ss.tableName))
+
+	rs, err := tx.QueryContext(ctx, query, pq.Array(sources))
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	return scanCacheRows(rs, columns)
+}
+
+// the historical rows selected by each key, the specified version or the latest version written at or before the
+// as of time, at most one per key per source. Each row notes the index of the key it was selected for. The history
+// table has the same columns as the cache table plus the version and time columns
+func (ss *sqlStore) historyRows(keys []historyKey, sources []string) ([]cacheRow, error) {
+
+	if len(ss.historyTable) == 0 {
+		return nil, ErrNoHistory
+	}
+
+	result := make([]cacheRow, 0, len(keys))
+	for offset := 0; offset < len(keys); offset += historyMaxKeyCount {
+		end := offset + historyMaxKeyCount
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		var rows []cacheRow
+		start := time.Now()
+		err := ss.withRetry("CacheHistory", func(ctx context.Context) error {
+			var err error
+			rows, err = ss.selectHistory(ctx, keys[offset:end], offset, sources)
+			return err
+		})
+		elapsed := int64(time.Since(start) / time.Millisecond)
+		warnIfSlow(elapsed, getRequestTimeLimit, fmt.Sprintf("CacheHistory (%d items)", end-offset))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, rows...)
+	}
+
+	return result, nil
+}
+
+// select the history rows for a batch of keys in one query. The keys are joined as a table of values and the
+// best row for each key and source is ranked first
+func (ss *sqlStore) selectHistory(ctx context.Context, keys []historyKey, offset int, sources []string) ([]cacheRow, error) {
+
+	params := dbx.Params{}
+	values := make([]string, 0, len(keys))
+	for ix, k := range keys {
+		n := strconv.Itoa(ix)
+		params["i"+n] = offset + ix
+		params["k"+n] = k.id
+		params["v"+n] = k.version
+		params["t"+n] = ss.timeParam(k.asOf)
+		values = append(values, fmt.Sprintf("(%s, {:k%s}, %s, %s)",
+			ss.typedParam("i"+n, "INTEGER"), n, ss.typedParam("v"+n, "INTEGER"), ss.typedParam("t"+n, "TIMESTAMPTZ")))
+	}
+
+	placeholders := make([]string, 0, len(sources))
+	for ix, source := range sources {
+		n := "s" + strconv.Itoa(ix)
+		params[n] = source
+		placeholders = append(placeholders, "{:"+n+"}")
+	}
+
+	columns := ss.payloadColumns()
+	outer := make([]string, 0, len(columns)+1)
+	for _, c := range columns {
+		outer = append(outer, "r."+ss.outputName(c))
+	}
+	outer = append(outer, "r.history_selection")
+
+	version := "h." + ss.db.QuoteColumnName(ss.versionColumn)
+	when := "h." + ss.db.QuoteColumnName(ss.timeColumn)
+	query := fmt.Sprintf("WITH k (ix, id, version, asof) AS (VALUES %s) "+
+		"SELECT %s FROM ("+
+		"SELECT %s, k.ix AS history_selection, "+
+		"ROW_NUMBER() OVER (PARTITION BY k.ix, h.source ORDER BY %s DESC, %s DESC) AS history_rank "+
+		"FROM %s h JOIN k ON h.id = k.id "+
+		"WHERE h.source IN (%s) AND ((k.version <> 0 AND %s = k.version) OR (k.version = 0 AND %s <= %s))"+
+		") r WHERE r.history_rank = 1",
+		strings.Join(values, ", "), strings.Join(outer, ", "), strings.Join(ss.selectExprs(columns, "h"), ", "),
+		when, version, ss.db.QuoteTableName(ss.historyTable), strings.Join(placeholders, ", "), version, ss.comparableTime(when),
+		ss.comparableTime("k.asof"))
+
+	rs, err := ss.db.NewQuery(query).Bind(params).WithContext(ctx).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+
+	return scanCacheRows(rs.Rows, append(columns, "history_selection"))
+}
+
+// the name a selected column has in the result
+func (ss *sqlStore) outputName(column string) string {
+
+	if column == "encoding" {
+		return "encoding"
+	}
+	return ss.db.QuoteColumnName(strings.TrimPrefix(column, extraColumnPrefix))
+}
+
+// a bound parameter with its type, postgres cannot infer the type of a parameter in a VALUES list
+func (ss *sqlStore) typedParam(name string, sqlType string) string {
+
+	if ss.db.DriverName() == "postgres" {
+		return fmt.Sprintf("CAST({:%s} AS %s)", name, sqlType)
+	}
+	return "{:" + name + "}"
+}
+
+// a time column or parameter ready for comparison. Sqlite has no timestamp type, times are text in whatever format
+// they were written (2024-01-01T00:00:00Z, 2024-01-01 00:00:00) which do not compare correctly as text so both sides
+// are compared as julian day numbers
+func (ss *sqlStore) comparableTime(expr string) string {
+
+	if ss.db.DriverName() == "sqlite" {
+		return "julianday(" + expr + ")"
+	}
+	return expr
+}
+
+// the value bound for a time parameter, sqlite gets UTC text that julianday understands
+func (ss *sqlStore) timeParam(t time.Time) interface{} {
+
+	if ss.db.DriverName() == "sqlite" {
+		return t.UTC().Format("2006-01-02T15:04:05.000Z")
+	}
+	return t
+}
+
+// stream every row matching the filter, a batch at a time. Streams are not retried because the rows already
+// delivered would be sent again
+func (ss *sqlStore) streamRows(filter CacheFilter, handler func([]cacheRow) error) (int, error) {
+
+	// this is a read only transaction so always rolling back is fine
+	tx, err := ss.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	where := dbx.In("source", toInterfaceArray(filter.Sources)...)
+	if len(filter.Types) != 0 {
+		where = dbx.And(where, dbx.In("type", toInterfaceArray(filter.Types)...))
+	}
+	if filter.Since.IsZero() == false {
+		where = dbx.And(where, dbx.NewExp(ss.comparableTime(ss.db.QuoteColumnName(filter.UpdatedColumn))+" >= "+
+			ss.comparableTime("{:since}"), dbx.Params{"since": ss.timeParam(filter.Since)}))
+	}
+	if filter.Until.IsZero() == false {
+		where = dbx.And(where, dbx.NewExp(ss.comparableTime(ss.db.QuoteColumnName(filter.UpdatedColumn))+" < "+
+			ss.comparableTime("{:until}"), dbx.Params{"until": ss.timeParam(filter.Until)}))
+	}
+
+	columns := ss.payloadColumns()
+	q := tx.Select(ss.selectExprs(columns, "")...).
+		From(ss.tableName).
+		Where(where).
+		Build()
+
+	var count int
+	if ss.cursor == true {
+		count, err = ss.streamCursor(tx, q, columns, handler)
+	} else {
+		count, err = ss.streamRowSet(q, columns, handler)
+	}
+
+	return count, err
+}
+
+// stream using a server side cursor, cursors only exist within a transaction
+func (ss *sqlStore) streamCursor(tx *dbx.Tx, q *dbx.Query, columns []string, handler func([]cacheRow) error) (int, error) {
+
+	ctx, cancel := ss.queryContext()
+	_, err := tx.NewQuery("DECLARE stream_cursor NO SCROLL CURSOR FOR " + q.SQL()).Bind(q.Params()).WithContext(ctx).Execute()
+	cancel()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	fetch := tx.NewQuery(fmt.Sprintf("FETCH %d FROM stream_cursor", streamFetchCount))
+	for {
+		start := time.Now()
+		ctx, cancel := ss.queryContext()
+		rows, err := ss.fetch(ctx, fetch, columns)
+		cancel()
+		elapsed := int64(time.Since(start) / time.Millisecond)
+		warnIfSlow(elapsed, getRequestTimeLimit, fmt.Sprintf("CacheStream (%d items)", streamFetchCount))
+
+		if err != nil {
+			return count, err
+		}
+
+		// we are done
+		if len(rows) == 0 {
+			break
+		}
+
+		err = ss.deliver(rows, &count, handler)
+		if err != nil {
+			return count, err
+		}
+	}
+
+	_, err = tx.NewQuery("CLOSE stream_cursor").Execute()
+	return count, err
+}
+
+// fetch the next batch of rows from the cursor
+func (ss *sqlStore) fetch(ctx context.Context, fetch *dbx.Query, columns []string) ([]cacheRow, error) {
+
+	rows, err := fetch.WithContext(ctx).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanCacheRows(rows.Rows, columns)
+}
+
+// stream by iterating the result set, used by backends that do not support cursors
+func (ss *sqlStore) streamRowSet(q *dbx.Query, columns []string, handler func([]cacheRow) error) (int, error) {
+
+	rows, err := q.Rows()
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	count := 0
+	batch := make([]cacheRow, 0, streamFetchCount)
+	for rows.Next() {
+		r, err := scanCacheRow(rows.Scan, columns)
+		if err != nil {
+			return count, err
+		}
+		batch = append(batch, r)
+
+		if len(batch) == streamFetchCount {
+			err = ss.deliver(batch, &count, handler)
+			if err != nil {
+				return count, err
+			}
+			batch = batch[:0]
+		}
+	}
+
+	if len(batch) != 0 {
+		err = ss.deliver(batch, &count, handler)
+		if err != nil {
+			return count, err
+		}
+	}
+
+	return count, rows.Err()
+}
+
+// the current time according to the database clock
+func (ss *sqlStore) now() (time.Time, error) {
+
+	var now time.Time
+	err := ss.withRetry("CacheNow", func(ctx context.Context) error {
+		// sqlite has no timestamp type so we ask for text in a format we can parse
+		if ss.db.DriverName() == "sqlite" {
+			var text string
+			err := ss.db.NewQuery("SELECT strftime('%Y-%m-%dT%H:%M:%fZ', 'now')").WithContext(ctx).Row(&text)
+			if err != nil {
+				return err
+			}
+			now, err = time.Parse(time.RFC3339Nano, text)
+			return err
+		}
+		return ss.db.NewQuery("SELECT now()").WithContext(ctx).Row(&now)
+	})
+
+	return now, err
+}
+
+// the column names of the cache table, selecting no rows works for every backend and fails if the table is missing
+func (ss *sqlStore) columns() ([]string, error) {
+
+	rows, err := ss.db.Select().From(ss.tableName).Limit(0).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return rows.Columns()
+}
+
+// the number of rows for each of the sources, sources with no rows are not included
+func (ss *sqlStore) sourceCounts(sources []string) (map[string]int, error) {
+
+	var counts []struct {
+		Source string `db:"source"`
+		Count  int    `db:"count"`
+	}
+
+	q := ss.db.Select("source", "COUNT(*) AS count").
+		From(ss.tableName).
+		Where(dbx.In("source", toInterfaceArray(sources)...)).
+		GroupBy("source")
+
+	err := q.All(&counts)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]int, len(counts))
+	for _, c := range counts {
+		result[c.Source] = c.Count
+	}
+	return result, nil
+}
+
+// scan all the rows from the result set
+func scanCacheRows(rows *sql.Rows, columns []string) ([]cacheRow, error) {
+
+	result := make([]cacheRow, 0)
+	for rows.Next() {
+		r, err := scanCacheRow(rows.Scan, columns)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+
+	return result, rows.Err()
+}
+
+// scan a row with the named columns. Additional columns can be of any type and may be null
+func scanCacheRow(scan func(...interface{}) error, columns []string) (cacheRow, error) {
+
+	var r cacheRow
+	extra := make([]sql.NullString, 0, len(columns))
+	names := make([]string, 0, len(columns))
+	fields := make([]interface{}, 0, len(columns))
+	for _, c := range columns {
+		switch c {
+		case "id":
+			fields = append(fields, &r.ID)
+		case "type":
+			fields = append(fields, &r.Type)
+		case "source":
+			fields = append(fields, &r.Source)
+		case "payload":
+			fields = append(fields, &r.Payload)
+		case "encoding":
+			fields = append(fields, &r.Encoding)
+		case "history_selection":
+			fields = append(fields, &r.Selection)
+		default:
+			// the capacity is sufficient so this never reallocates
+			extra = append(extra, sql.NullString{})
+			names = append(names, strings.TrimPrefix(c, extraColumnPrefix))
+			fields = append(fields, &extra[len(extra)-1])
+		}
+	}
+
+	err := scan(fields...)
+	if err != nil {
+		return r, err
+	}
+
+	if len(extra) != 0 {
+		r.Extra = make(map[string]string, len(extra))
+		for ix, e := range extra {
+			r.Extra[names[ix]] = e.String
+		}
+	}
+	return r, nil
+}
+
+// a context with the query deadline applied
+func (ss *sqlStore) queryContext() (context.Context, context.CancelFunc) {
+
+	if ss.queryTimeout == 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), ss.queryTimeout)
+}
+
+// run the query, retrying with an exponential backoff if it fails with a transient error
+func (ss *sqlStore) withRetry(label string, query func(context.Context) error) error {
+
+	backoff := ss.retryBackoff
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := ss.queryContext()
+		err := query(ctx)
+		cancel()
+
+		if err == nil || attempt >= ss.retries || isTransientError(err) == false {
+			return err
+		}
+
+		log.Printf("WARNING: %s failed (%s), retrying in %s (attempt %d of %d)", label, err.Error(), backoff, attempt+1, ss.retries)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// is this an error worth retrying, typically a lost connection, a failover or a query timeout
+func isTransientError(err error) bool {
+
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) == true {
+		return true
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) == true {
+		switch {
+		case pqErr.Code.Class() == "08": // connection exception
+			return true
+		case pqErr.Code == "57P01", pqErr.Code == "57P02", pqErr.Code == "57P03": // shutdown or not yet accepting connections
+			return true
+		case pqErr.Code == "40001", pqErr.Code == "40P01": // serialization failure or deadlock
+			return true
+		case pqErr.Code == "25006": // read only transaction, the primary has just failed over
+			return true
+		}
+	}
+
+	return false
+}
+
+// hand a batch of rows to the handler and keep track of progress
+func (ss *sqlStore) deliver(rows []cacheRow, count *int, handler func([]cacheRow) error) error {
+
+	err := handler(rows)
+	if err != nil {
+		return err
+	}
+
+	before := *count
+	*count += len(rows)
+	if *count/(streamFetchCount*100) != before/(streamFetchCount*100) {
+		log.Printf("INFO: streamed %d records", *count)
+	}
+	return nil
+}
+
+//
+// end of file
+//
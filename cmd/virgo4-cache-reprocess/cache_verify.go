@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// ErrCacheSchema - the cache table is missing or does not look the way we expect
+var ErrCacheSchema = fmt.Errorf("cache schema verification failed")
+
+// the columns every cache table must have
+var requiredCacheColumns = []string{"id", "type", "source", "payload"}
+
+// verify the cache table exists with the columns we need (including any additional configured ones) and that each
+// data source has some rows, so that configuration mistakes are found at startup rather than on the first notification
+func verifyCacheSchema(store cacheStore, dataSources []string, updatedColumn string, additionalColumns []string) error {
+
+	columns, err := store.columns()
+	if err != nil {
+		return fmt.Errorf("%w: cannot read the cache table (%s)", ErrCacheSchema, err.Error())
+	}
+
+	// column names are compared case insensitively
+	present := make(map[string]bool, len(columns))
+	for _, c := range columns {
+		present[strings.ToLower(c)] = true
+	}
+
+	required := append([]string{}, requiredCacheColumns...)
+	for _, c := range additionalColumns {
+		required = append(required, strings.ToLower(c))
+	}
+
+	missing := make([]string, 0)
+	for _, c := range required {
+		if present[c] == false {
+			missing = append(missing, c)
+		}
+	}
+	if len(missing) != 0 {
+		return fmt.Errorf("%w: cache table is missing required column(s) [%s], found [%s]", ErrCacheSchema,
+			strings.Join(missing, ", "), strings.Join(columns, ", "))
+	}
+
+	// only incremental jobs need this so it is not fatal
+	if len(updatedColumn) != 0 && present[strings.ToLower(updatedColumn)] == false {
+		log.Printf("WARNING: cache table has no [%s] column, incremental jobs will fail", updatedColumn)
+	}
+
+	counts, err := store.sourceCounts(dataSources)
+	if err != nil {
+		return fmt.Errorf("%w: cannot count the cache rows (%s)", ErrCacheSchema, err.Error())
+	}
+
+	empty := make([]string, 0)
+	for _, source := range dataSources {
+		log.Printf("INFO: cache contains %d rows for data source [%s]", counts[source], source)
+		if counts[source] == 0 {
+			empty = append(empty, source)
+		}
+	}
+	if len(empty) != 0 {
+		sort.Strings(empty)
+		return fmt.Errorf("%w: no cache rows for data source(s) [%s]", ErrCacheSchema, strings.Join(empty, ", "))
+	}
+
+	return nil
+}
+
+//
+// end of file
+//
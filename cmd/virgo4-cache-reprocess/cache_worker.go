@@ -6,7 +6,7 @@ import (
 	"time"
 )
 
-func cache_worker(id int, cache CacheProxy, inbound <-chan Record, outbound chan<- awssqs.Message) {
+func cache_worker(id int, cache CacheProxy, stage *OutboundStage, inbound <-chan Record, outbound chan<- awssqs.Message) {
 
 	// we get from the cache in blocks
 	bsize := uint(getCacheMaxKeyCount)
@@ -34,7 +34,7 @@ func cache_worker(id int, cache CacheProxy, inbound <-chan Record, outbound chan
 			if count != 0 && count%bsize == bsize-1 {
 
 				// get a batch of records from the cache
-				messages, err := batchCacheGet(cache, block)
+				messages, err := batchCacheGet(cache, stage, block)
 				fatalIfError(err)
 
 				// and send them to the outbound queue
@@ -55,7 +55,7 @@ func cache_worker(id int, cache CacheProxy, inbound <-chan Record, outbound chan
 			// we timed out waiting for new messages, let's flush what we have (if anything)
 			if len(block) != 0 {
 
-				messages, err := batchCacheGet(cache, block)
+				messages, err := batchCacheGet(cache, stage, block)
 				fatalIfError(err)
 
 				// and send them to the outbound queue
@@ -77,21 +77,29 @@ func cache_worker(id int, cache CacheProxy, inbound <-chan Record, outbound chan
 	// should never get here
 }
 
-// look up a set of keys in the cache. We have already verified that the keys all exist so we expect failures to
-// be fatal
-func batchCacheGet(cache CacheProxy, records []Record) ([]awssqs.Message, error) {
+// look up a set of records in the cache and prepare them for sending. We have already verified that the records
+// all exist so we expect failures to be fatal
+func batchCacheGet(cache CacheProxy, stage *OutboundStage, records []Record) ([]awssqs.Message, error) {
 
-	keys := make([]string, 0, len(records))
-	for _, m := range records {
-		keys = append(keys, m.Id())
-	}
-
-	messages, err := cache.Get(keys)
+	messages, err := cache.Get(records)
 	if err != nil {
 		return nil, err
 	}
 
-	return messages, nil
+	// prepare the messages for sending, any that are quarantined are not sent. Id files have no per job transforms
+	// (only job definitions do) so just the configured per source transforms apply
+	prepared := messages[:0]
+	for ix := range messages {
+		send, err := stage.Prepare(&messages[ix], nil)
+		if err != nil {
+			return nil, err
+		}
+		if send == true {
+			prepared = append(prepared, messages[ix])
+		}
+	}
+
+	return prepared, nil
 }
 
 //
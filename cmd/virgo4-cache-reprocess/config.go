@@ -4,6 +4,7 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
 )
 
 // ServiceConfig defines all of the service configuration parameters
@@ -13,20 +14,82 @@ type ServiceConfig struct {
 	PollTimeOut  int64  // the SQS queue timeout (in seconds)
 
 	DataSourceNames   string // the data sources to include in the query
+	SourcePrecedence  string // how to handle an id that exists in more than one data source
 	MessageBucketName string // the bucket to use for large messages
 	DownloadDir       string // the S3 file download directory (local)
 
+	CacheBackend string // which cache backend to use (postgres, sqlite or memory)
+	SqliteFile   string // the sqlite database file (sqlite backend)
+	SqliteTable  string // which table to use (sqlite backend)
+	MemoryFile   string // a JSON lines file of cache rows to load (memory backend, optional)
+
+	SourceTableSpec string            // the data sources that have their own table (postgres and sqlite backends)
+	SourceTables    map[string]string // and the parsed version
+
+	VerifyCacheSchema bool // verify the cache table and data sources at startup (not the default for an empty memory backend)
+
+	HistoryTable         string // the cache history table, empty if historical payloads are not available (SQL backends only)
+	HistoryVersionColumn string // the payload version column in the history table
+	HistoryTimeColumn    string // and the column with the time each version was written
+
+	PayloadCompressionSpec string             // how compressed payloads are handled for each data source
+	PayloadCompression     PayloadCompression // and the parsed version
+	PayloadEncodingColumn  string             // the payload content encoding column, empty if there is not one
+	TransformFile          string             // a JSON file of per source payload transforms (optional)
+	AttributeColumnSpec    string             // additional cache columns to send as message attributes
+	AttributeColumns       []AttributeColumn  // and the parsed version
+	TombstoneSpec          string             // the conditions that identify withdrawn records in the cache
+	Tombstones             Tombstones         // and the parsed version
+	PayloadValidationSpec  string             // the payload checks for each record type
+	PayloadValidator       PayloadValidator   // and the parsed version
+	QuarantineBucket       string             // the bucket for reports of records that fail validation, empty to only log them
+	QuarantinePrefix       string             // and the key prefix
+
 	PostgresHost     string // the postgres endpoint
 	PostgresPort     int    // and port
 	PostgresUser     string // username
 	PostgresPass     string // and password
+	PostgresUserFile string // a file containing the username, re-read for each new connection (optional)
+	PostgresPassFile string // a file containing the password, re-read for each new connection (optional)
 	PostgresDatabase string // which database to use
 	PostgresTable    string // which table to use
 
+	PostgresSourceDatabaseSpec string            // the data sources that live in their own database (same host and credentials)
+	PostgresSourceDatabases    map[string]string // and the parsed version
+
+	PostgresSSLMode        string // the postgres sslmode, empty for the driver default
+	PostgresSSLRootCert    string // the root certificate used to verify the server (optional)
+	PostgresConnectTimeout int    // the connection timeout (in seconds)
+
+	PostgresLookupStrategy string // how rows are selected by key (in, any or temp)
+	PostgresTempMinKeys    int    // the smallest batch that uses a temp table join (temp strategy)
+
+	PostgresMaxOpenConns    int // the maximum number of open connections, zero for unlimited
+	PostgresMaxIdleConns    int // the maximum number of idle connections, zero for the default
+	PostgresConnMaxLifetime int // the maximum connection lifetime (in seconds), zero for unlimited
+	PostgresConnMaxIdleTime int // the maximum connection idle time (in seconds), zero for unlimited
+	PostgresQueryTimeout    int // the deadline for each query (in seconds), zero for none
+	PostgresRetries         int // the number of times a query failing with a transient error is retried
+	PostgresRetryBackoff    int // the initial delay between retries (in milliseconds), doubled each time
+
+	PostgresUpdatedColumn string // the update timestamp column used by incremental jobs
+	WatermarkBucket       string // the bucket used to persist incremental job watermarks, empty to disable
+	WatermarkPrefix       string // and the key prefix
+	WatermarkLag          int    // how far behind the database clock incremental jobs stop (in seconds)
+
 	InboundWorkerQueueSize  int // the message queue size that feeds the cache workers
 	CacheWorkers            int // the number of cache worker processes
 	OutboundWorkerQueueSize int // the message queue size that feeds the send workers
 	SendWorkers             int // the number of send worker processes
+
+	ParsePolicy          ParsePolicy // how tolerant we are of the lines in an input file
+	ValidationErrorLimit int         // the maximum number of validation problems of each kind to report
+	ValidationWorkers    int         // the number of concurrent cache lookups when validating a file
+	DedupMaxKeys         int         // the maximum number of ids tracked for deduplication (about 100 bytes each), 0 for no limit
+	ValidationBucket     string      // the bucket for validation reports, empty to only log them
+	ValidationPrefix     string      // and the key prefix
+	IdRuleSpec           string      // the per data source id syntax rules
+	IdRules              IdRules     // and the parsed version
 }
 
 func ensureSet(env string) string {
@@ -59,6 +122,55 @@ func envToInt(env string) int {
 	return n
 }
 
+func envWithDefault(env string, defaultValue string) string {
+	val, set := os.LookupEnv(env)
+
+	if set == false {
+		return defaultValue
+	}
+
+	return val
+}
+
+func envToIntWithDefault(env string, defaultValue int) int {
+	val := envWithDefault(env, "")
+
+	if val == "" {
+		return defaultValue
+	}
+
+	n, err := strconv.Atoi(val)
+	fatalIfError(err)
+	return n
+}
+
+func envToBoolWithDefault(env string, defaultValue bool) bool {
+	val := envWithDefault(env, "")
+
+	if val == "" {
+		return defaultValue
+	}
+
+	b, err := strconv.ParseBool(val)
+	fatalIfError(err)
+	return b
+}
+
+// the additional columns selected with each cache row, used for attributes and tombstone detection
+func (cfg *ServiceConfig) extraColumns() []string {
+	return uniqueStrings(append(attributeColumnNames(cfg.AttributeColumns), cfg.Tombstones.columns()...))
+}
+
+// the cache columns we need in addition to the standard ones
+func (cfg *ServiceConfig) additionalColumns() []string {
+
+	columns := cfg.extraColumns()
+	if len(cfg.PayloadEncodingColumn) != 0 {
+		columns = append(columns, cfg.PayloadEncodingColumn)
+	}
+	return columns
+}
+
 // LoadConfiguration will load the service configuration from env/cmdline
 // and return a pointer to it. Any failures are fatal.
 func LoadConfiguration() *ServiceConfig {
@@ -69,35 +181,197 @@ func LoadConfiguration() *ServiceConfig {
 	cfg.OutQueueName = ensureSetAndNonEmpty("VIRGO4_CACHE_REPROCESS_OUT_QUEUE")
 	cfg.PollTimeOut = int64(envToInt("VIRGO4_CACHE_REPROCESS_QUEUE_POLL_TIMEOUT"))
 	cfg.DataSourceNames = ensureSetAndNonEmpty("VIRGO4_CACHE_REPROCESS_DATA_SOURCE")
+	cfg.SourcePrecedence = envWithDefault("VIRGO4_CACHE_REPROCESS_SOURCE_PRECEDENCE", SourcePrecedenceOrdered)
 	cfg.MessageBucketName = ensureSetAndNonEmpty("VIRGO4_SQS_MESSAGE_BUCKET")
 	cfg.DownloadDir = ensureSetAndNonEmpty("VIRGO4_CACHE_REPROCESS_DOWNLOAD_DIR")
-	cfg.PostgresHost = ensureSetAndNonEmpty("VIRGO4_CACHE_REPROCESS_POSTGRES_HOST")
-	cfg.PostgresPort = envToInt("VIRGO4_CACHE_REPROCESS_POSTGRES_PORT")
-	cfg.PostgresUser = ensureSetAndNonEmpty("VIRGO4_CACHE_REPROCESS_POSTGRES_USER")
-	cfg.PostgresPass = ensureSetAndNonEmpty("VIRGO4_CACHE_REPROCESS_POSTGRES_PASS")
-	cfg.PostgresDatabase = ensureSetAndNonEmpty("VIRGO4_CACHE_REPROCESS_POSTGRES_DATABASE")
-	cfg.PostgresTable = ensureSetAndNonEmpty("VIRGO4_CACHE_REPROCESS_POSTGRES_TABLE")
+	cfg.CacheBackend = envWithDefault("VIRGO4_CACHE_REPROCESS_CACHE_BACKEND", CacheBackendPostgres)
+	switch cfg.CacheBackend {
+	case CacheBackendPostgres:
+		cfg.PostgresHost = ensureSetAndNonEmpty("VIRGO4_CACHE_REPROCESS_POSTGRES_HOST")
+		cfg.PostgresPort = envToInt("VIRGO4_CACHE_REPROCESS_POSTGRES_PORT")
+		// credentials can come from mounted files rather than the environment
+		cfg.PostgresUserFile = envWithDefault("VIRGO4_CACHE_REPROCESS_POSTGRES_USER_FILE", "")
+		if len(cfg.PostgresUserFile) == 0 {
+			cfg.PostgresUser = ensureSetAndNonEmpty("VIRGO4_CACHE_REPROCESS_POSTGRES_USER")
+		}
+		cfg.PostgresPassFile = envWithDefault("VIRGO4_CACHE_REPROCESS_POSTGRES_PASS_FILE", "")
+		if len(cfg.PostgresPassFile) == 0 {
+			cfg.PostgresPass = ensureSetAndNonEmpty("VIRGO4_CACHE_REPROCESS_POSTGRES_PASS")
+		}
+		cfg.PostgresDatabase = ensureSetAndNonEmpty("VIRGO4_CACHE_REPROCESS_POSTGRES_DATABASE")
+		cfg.PostgresTable = ensureSetAndNonEmpty("VIRGO4_CACHE_REPROCESS_POSTGRES_TABLE")
+		cfg.PostgresSourceDatabaseSpec = envWithDefault("VIRGO4_CACHE_REPROCESS_POSTGRES_SOURCE_DATABASES", "")
+		cfg.PostgresSSLMode = envWithDefault("VIRGO4_CACHE_REPROCESS_POSTGRES_SSLMODE", "")
+		cfg.PostgresSSLRootCert = envWithDefault("VIRGO4_CACHE_REPROCESS_POSTGRES_SSLROOTCERT", "")
+		cfg.PostgresConnectTimeout = envToIntWithDefault("VIRGO4_CACHE_REPROCESS_POSTGRES_CONNECT_TIMEOUT", 30)
+		cfg.PostgresLookupStrategy = envWithDefault("VIRGO4_CACHE_REPROCESS_POSTGRES_LOOKUP_STRATEGY", LookupStrategyIn)
+		// the largest get batch, so full get batches use the temp table as well as lookups
+		cfg.PostgresTempMinKeys = envToIntWithDefault("VIRGO4_CACHE_REPROCESS_POSTGRES_TEMP_TABLE_MIN_KEYS", getCacheMaxKeyCount)
+		cfg.PostgresMaxOpenConns = envToIntWithDefault("VIRGO4_CACHE_REPROCESS_POSTGRES_MAX_OPEN_CONNS", 0)
+		cfg.PostgresMaxIdleConns = envToIntWithDefault("VIRGO4_CACHE_REPROCESS_POSTGRES_MAX_IDLE_CONNS", 0)
+		cfg.PostgresConnMaxLifetime = envToIntWithDefault("VIRGO4_CACHE_REPROCESS_POSTGRES_CONN_MAX_LIFETIME", 0)
+		cfg.PostgresConnMaxIdleTime = envToIntWithDefault("VIRGO4_CACHE_REPROCESS_POSTGRES_CONN_MAX_IDLE_TIME", 0)
+		cfg.PostgresQueryTimeout = envToIntWithDefault("VIRGO4_CACHE_REPROCESS_POSTGRES_QUERY_TIMEOUT", 0)
+		cfg.PostgresRetries = envToIntWithDefault("VIRGO4_CACHE_REPROCESS_POSTGRES_RETRIES", 3)
+		cfg.PostgresRetryBackoff = envToIntWithDefault("VIRGO4_CACHE_REPROCESS_POSTGRES_RETRY_BACKOFF", 500)
+	case CacheBackendSqlite:
+		cfg.SqliteFile = ensureSetAndNonEmpty("VIRGO4_CACHE_REPROCESS_SQLITE_FILE")
+		cfg.SqliteTable = envWithDefault("VIRGO4_CACHE_REPROCESS_SQLITE_TABLE", "cache")
+	case CacheBackendMemory:
+		cfg.MemoryFile = envWithDefault("VIRGO4_CACHE_REPROCESS_MEMORY_FILE", "")
+	default:
+		log.Printf("FATAL ERROR: unsupported cache backend: [%s]", cfg.CacheBackend)
+		os.Exit(1)
+	}
+	cfg.SourceTableSpec = envWithDefault("VIRGO4_CACHE_REPROCESS_SOURCE_TABLES", "")
+	cfg.HistoryTable = envWithDefault("VIRGO4_CACHE_REPROCESS_HISTORY_TABLE", "")
+	cfg.HistoryVersionColumn = envWithDefault("VIRGO4_CACHE_REPROCESS_HISTORY_VERSION_COLUMN", "version")
+	cfg.HistoryTimeColumn = envWithDefault("VIRGO4_CACHE_REPROCESS_HISTORY_TIME_COLUMN", "updated_at")
+	// an empty memory backend (no file to load) has no rows for the data sources so is not verified by default
+	verifyDefault := cfg.CacheBackend != CacheBackendMemory || len(cfg.MemoryFile) != 0
+	cfg.VerifyCacheSchema = envToBoolWithDefault("VIRGO4_CACHE_REPROCESS_VERIFY_CACHE_SCHEMA", verifyDefault)
+	cfg.PayloadCompressionSpec = envWithDefault("VIRGO4_CACHE_REPROCESS_PAYLOAD_COMPRESSION", "")
+	cfg.PayloadEncodingColumn = envWithDefault("VIRGO4_CACHE_REPROCESS_PAYLOAD_ENCODING_COLUMN", "")
+	cfg.TransformFile = envWithDefault("VIRGO4_CACHE_REPROCESS_TRANSFORM_FILE", "")
+	cfg.AttributeColumnSpec = envWithDefault("VIRGO4_CACHE_REPROCESS_ATTRIBUTE_COLUMNS", "")
+	cfg.TombstoneSpec = envWithDefault("VIRGO4_CACHE_REPROCESS_TOMBSTONE", "")
+	cfg.PayloadValidationSpec = envWithDefault("VIRGO4_CACHE_REPROCESS_PAYLOAD_VALIDATION", "*=non-empty")
+	cfg.QuarantineBucket = envWithDefault("VIRGO4_CACHE_REPROCESS_QUARANTINE_BUCKET", "")
+	cfg.QuarantinePrefix = envWithDefault("VIRGO4_CACHE_REPROCESS_QUARANTINE_PREFIX", "quarantine/")
+	cfg.PostgresUpdatedColumn = envWithDefault("VIRGO4_CACHE_REPROCESS_POSTGRES_UPDATED_COLUMN", "updated_at")
+	cfg.WatermarkBucket = envWithDefault("VIRGO4_CACHE_REPROCESS_WATERMARK_BUCKET", "")
+	cfg.WatermarkPrefix = envWithDefault("VIRGO4_CACHE_REPROCESS_WATERMARK_PREFIX", "watermarks/")
+	cfg.WatermarkLag = envToIntWithDefault("VIRGO4_CACHE_REPROCESS_WATERMARK_LAG", 60)
 	cfg.InboundWorkerQueueSize = envToInt("VIRGO4_CACHE_REPROCESS_INBOUND_WORK_QUEUE_SIZE")
 	cfg.CacheWorkers = envToInt("VIRGO4_CACHE_REPROCESS_CACHE_WORKERS")
 	cfg.OutboundWorkerQueueSize = envToInt("VIRGO4_CACHE_REPROCESS_OUTBOUND_WORK_QUEUE_SIZE")
 	cfg.SendWorkers = envToInt("VIRGO4_CACHE_REPROCESS_SEND_WORKERS")
+	cfg.ParsePolicy.TrimWhitespace = envToBoolWithDefault("VIRGO4_CACHE_REPROCESS_PARSE_TRIM_WHITESPACE", true)
+	cfg.ParsePolicy.SkipBlank = envToBoolWithDefault("VIRGO4_CACHE_REPROCESS_PARSE_SKIP_BLANK", true)
+	cfg.ParsePolicy.CommentPrefix = envWithDefault("VIRGO4_CACHE_REPROCESS_PARSE_COMMENT_PREFIX", "#")
+	cfg.ValidationErrorLimit = envToIntWithDefault("VIRGO4_CACHE_REPROCESS_VALIDATION_ERROR_LIMIT", 100)
+	cfg.ValidationWorkers = envToIntWithDefault("VIRGO4_CACHE_REPROCESS_VALIDATION_WORKERS", 4)
+	cfg.DedupMaxKeys = envToIntWithDefault("VIRGO4_CACHE_REPROCESS_DEDUP_MAX_KEYS", 2000000)
+	cfg.ValidationBucket = envWithDefault("VIRGO4_CACHE_REPROCESS_VALIDATION_BUCKET", "")
+	cfg.ValidationPrefix = envWithDefault("VIRGO4_CACHE_REPROCESS_VALIDATION_PREFIX", "validation/")
+	cfg.IdRuleSpec = envWithDefault("VIRGO4_CACHE_REPROCESS_ID_RULES", "")
 
 	log.Printf("[CONFIG] InQueueName             = [%s]", cfg.InQueueName)
 	log.Printf("[CONFIG] OutQueueName            = [%s]", cfg.OutQueueName)
 	log.Printf("[CONFIG] PollTimeOut             = [%d]", cfg.PollTimeOut)
 	log.Printf("[CONFIG] DataSourceNames         = [%s]", cfg.DataSourceNames)
+	log.Printf("[CONFIG] SourcePrecedence        = [%s]", cfg.SourcePrecedence)
 	log.Printf("[CONFIG] MessageBucketName       = [%s]", cfg.MessageBucketName)
 	log.Printf("[CONFIG] DownloadDir             = [%s]", cfg.DownloadDir)
+	log.Printf("[CONFIG] CacheBackend            = [%s]", cfg.CacheBackend)
+	log.Printf("[CONFIG] SqliteFile              = [%s]", cfg.SqliteFile)
+	log.Printf("[CONFIG] SqliteTable             = [%s]", cfg.SqliteTable)
+	log.Printf("[CONFIG] MemoryFile              = [%s]", cfg.MemoryFile)
+	log.Printf("[CONFIG] SourceTables            = [%s]", cfg.SourceTableSpec)
+	log.Printf("[CONFIG] HistoryTable            = [%s]", cfg.HistoryTable)
+	log.Printf("[CONFIG] HistoryVersionColumn    = [%s]", cfg.HistoryVersionColumn)
+	log.Printf("[CONFIG] HistoryTimeColumn       = [%s]", cfg.HistoryTimeColumn)
+	log.Printf("[CONFIG] VerifyCacheSchema       = [%t]", cfg.VerifyCacheSchema)
+	log.Printf("[CONFIG] PayloadCompression      = [%s]", cfg.PayloadCompressionSpec)
+	log.Printf("[CONFIG] PayloadEncodingColumn   = [%s]", cfg.PayloadEncodingColumn)
+	log.Printf("[CONFIG] TransformFile           = [%s]", cfg.TransformFile)
+	log.Printf("[CONFIG] AttributeColumns        = [%s]", cfg.AttributeColumnSpec)
+	log.Printf("[CONFIG] Tombstone               = [%s]", cfg.TombstoneSpec)
+	log.Printf("[CONFIG] PayloadValidation       = [%s]", cfg.PayloadValidationSpec)
+	log.Printf("[CONFIG] QuarantineBucket        = [%s]", cfg.QuarantineBucket)
+	log.Printf("[CONFIG] QuarantinePrefix        = [%s]", cfg.QuarantinePrefix)
 	log.Printf("[CONFIG] PostgresHost            = [%s]", cfg.PostgresHost)
 	log.Printf("[CONFIG] PostgresPort            = [%d]", cfg.PostgresPort)
 	log.Printf("[CONFIG] PostgresUser            = [%s]", cfg.PostgresUser)
 	log.Printf("[CONFIG] PostgresPass            = [REDACTED]")
+	log.Printf("[CONFIG] PostgresUserFile        = [%s]", cfg.PostgresUserFile)
+	log.Printf("[CONFIG] PostgresPassFile        = [%s]", cfg.PostgresPassFile)
 	log.Printf("[CONFIG] PostgresDatabase        = [%s]", cfg.PostgresDatabase)
 	log.Printf("[CONFIG] PostgresTable           = [%s]", cfg.PostgresTable)
+	log.Printf("[CONFIG] PostgresSourceDatabases = [%s]", cfg.PostgresSourceDatabaseSpec)
+	log.Printf("[CONFIG] PostgresSSLMode         = [%s]", cfg.PostgresSSLMode)
+	log.Printf("[CONFIG] PostgresSSLRootCert     = [%s]", cfg.PostgresSSLRootCert)
+	log.Printf("[CONFIG] PostgresConnectTimeout  = [%d]", cfg.PostgresConnectTimeout)
+	log.Printf("[CONFIG] PostgresLookupStrategy  = [%s]", cfg.PostgresLookupStrategy)
+	log.Printf("[CONFIG] PostgresTempMinKeys     = [%d]", cfg.PostgresTempMinKeys)
+	log.Printf("[CONFIG] PostgresMaxOpenConns    = [%d]", cfg.PostgresMaxOpenConns)
+	log.Printf("[CONFIG] PostgresMaxIdleConns    = [%d]", cfg.PostgresMaxIdleConns)
+	log.Printf("[CONFIG] PostgresConnMaxLifetime = [%d]", cfg.PostgresConnMaxLifetime)
+	log.Printf("[CONFIG] PostgresConnMaxIdleTime = [%d]", cfg.PostgresConnMaxIdleTime)
+	log.Printf("[CONFIG] PostgresQueryTimeout    = [%d]", cfg.PostgresQueryTimeout)
+	log.Printf("[CONFIG] PostgresRetries         = [%d]", cfg.PostgresRetries)
+	log.Printf("[CONFIG] PostgresRetryBackoff    = [%d]", cfg.PostgresRetryBackoff)
+	log.Printf("[CONFIG] PostgresUpdatedColumn   = [%s]", cfg.PostgresUpdatedColumn)
+	log.Printf("[CONFIG] WatermarkBucket         = [%s]", cfg.WatermarkBucket)
+	log.Printf("[CONFIG] WatermarkPrefix         = [%s]", cfg.WatermarkPrefix)
+	log.Printf("[CONFIG] WatermarkLag            = [%d]", cfg.WatermarkLag)
 	log.Printf("[CONFIG] InboundWorkerQueueSize  = [%d]", cfg.InboundWorkerQueueSize)
 	log.Printf("[CONFIG] CacheWorkers            = [%d]", cfg.CacheWorkers)
 	log.Printf("[CONFIG] OutboundWorkerQueueSize = [%d]", cfg.OutboundWorkerQueueSize)
 	log.Printf("[CONFIG] SendWorkers             = [%d]", cfg.SendWorkers)
+	log.Printf("[CONFIG] ParseTrimWhitespace     = [%t]", cfg.ParsePolicy.TrimWhitespace)
+	log.Printf("[CONFIG] ParseSkipBlank          = [%t]", cfg.ParsePolicy.SkipBlank)
+	log.Printf("[CONFIG] ParseCommentPrefix      = [%s]", cfg.ParsePolicy.CommentPrefix)
+	log.Printf("[CONFIG] ValidationErrorLimit    = [%d]", cfg.ValidationErrorLimit)
+	log.Printf("[CONFIG] ValidationWorkers       = [%d]", cfg.ValidationWorkers)
+	log.Printf("[CONFIG] DedupMaxKeys            = [%d]", cfg.DedupMaxKeys)
+	log.Printf("[CONFIG] ValidationBucket        = [%s]", cfg.ValidationBucket)
+	log.Printf("[CONFIG] ValidationPrefix        = [%s]", cfg.ValidationPrefix)
+	log.Printf("[CONFIG] IdRules                 = [%s]", cfg.IdRuleSpec)
+
+	var err error
+	cfg.IdRules, err = ParseIdRules(cfg.IdRuleSpec)
+	fatalIfError(err)
+	cfg.PayloadCompression, err = ParsePayloadCompression(cfg.PayloadCompressionSpec)
+	fatalIfError(err)
+	cfg.PayloadValidator, err = ParsePayloadValidation(cfg.PayloadValidationSpec)
+	fatalIfError(err)
+	cfg.AttributeColumns, err = ParseAttributeColumns(cfg.AttributeColumnSpec)
+	fatalIfError(err)
+	cfg.Tombstones, err = ParseTombstones(cfg.TombstoneSpec)
+	fatalIfError(err)
+	cfg.SourceTables, err = ParseSourceRoutes(cfg.SourceTableSpec)
+	fatalIfError(err)
+	cfg.PostgresSourceDatabases, err = ParseSourceRoutes(cfg.PostgresSourceDatabaseSpec)
+	fatalIfError(err)
+
+	if cfg.CacheBackend == CacheBackendMemory && len(cfg.SourceTables) != 0 {
+		log.Printf("FATAL ERROR: the %s cache backend does not support per source tables", cfg.CacheBackend)
+		os.Exit(1)
+	}
+
+	// a route for a source we do not process is almost certainly a typo
+	for _, routes := range []map[string]string{cfg.SourceTables, cfg.PostgresSourceDatabases} {
+		for source := range routes {
+			if contains(strings.Fields(cfg.DataSourceNames), source) == false {
+				log.Printf("FATAL ERROR: source [%s] has its own table or database but is not a configured data source", source)
+				os.Exit(1)
+			}
+		}
+	}
+
+	if cfg.CacheBackend == CacheBackendMemory && len(cfg.HistoryTable) != 0 {
+		log.Printf("FATAL ERROR: the %s cache backend does not support a history table", cfg.CacheBackend)
+		os.Exit(1)
+	}
+
+	if cfg.SourcePrecedence != SourcePrecedenceOrdered && cfg.SourcePrecedence != SourcePrecedenceAll {
+		log.Printf("FATAL ERROR: unsupported source precedence: [%s]", cfg.SourcePrecedence)
+		os.Exit(1)
+	}
+
+	if cfg.CacheBackend == CacheBackendPostgres &&
+		cfg.PostgresLookupStrategy != LookupStrategyIn && cfg.PostgresLookupStrategy != LookupStrategyAny && cfg.PostgresLookupStrategy != LookupStrategyTempTable {
+		log.Printf("FATAL ERROR: unsupported postgres lookup strategy: [%s]", cfg.PostgresLookupStrategy)
+		os.Exit(1)
+	}
+
+	// smaller batches fall back to the any strategy
+	if cfg.CacheBackend == CacheBackendPostgres && cfg.PostgresLookupStrategy == LookupStrategyTempTable &&
+		cfg.PostgresTempMinKeys > getCacheMaxKeyCount {
+		log.Printf("WARNING: cache gets are at most %d keys, fewer than PostgresTempMinKeys, so they will use the %s strategy",
+			getCacheMaxKeyCount, LookupStrategyAny)
+	}
 
 	return &cfg
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// the compression formats we understand
+const (
+	compressionNone  = "none"
+	compressionGzip  = "gzip"
+	compressionBzip2 = "bzip2"
+	compressionZstd  = "zstd"
+)
+
+// the magic bytes at the start of each compressed format
+var gzipMagic = []byte{0x1f, 0x8b}
+var bzip2Magic = []byte{'B', 'Z', 'h'}
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// a reader over a possibly compressed file, closing it closes everything underneath
+type decompressReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+// open the specified file and return a reader that provides the decompressed contents
+func openDecompressed(filename string) (*decompressReader, error) {
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	buffered := bufio.NewReader(file)
+	compression, err := detectCompression(filename, buffered)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	dr := &decompressReader{closers: []io.Closer{file}}
+
+	switch compression {
+	case compressionGzip:
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		dr.Reader = gz
+		dr.closers = append([]io.Closer{gz}, dr.closers...)
+
+	case compressionBzip2:
+		dr.Reader = bzip2.NewReader(buffered)
+
+	case compressionZstd:
+		zs, err := zstd.NewReader(buffered)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		dr.Reader = zs
+		dr.closers = append([]io.Closer{zs.IOReadCloser()}, dr.closers...)
+
+	default:
+		dr.Reader = buffered
+	}
+
+	return dr, nil
+}
+
+// remove any compression extension from the filename
+func stripCompressionExtension(filename string) string {
+
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".gz", ".gzip", ".bz2", ".bzip2", ".zst", ".zstd":
+		return strings.TrimSuffix(filename, filepath.Ext(filename))
+	}
+
+	return filename
+}
+
+// determine the compression format, first by file extension and then by magic bytes
+func detectCompression(filename string, reader *bufio.Reader) (string, error) {
+
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".gz", ".gzip":
+		return compressionGzip, nil
+	case ".bz2", ".bzip2":
+		return compressionBzip2, nil
+	case ".zst", ".zstd":
+		return compressionZstd, nil
+	}
+
+	// peek returns an error if the file is shorter than requested, that's OK, we just compare what we got
+	magic, err := reader.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		log.Printf("INFO: %s appears to be gzip compressed", filename)
+		return compressionGzip, nil
+	case bytes.HasPrefix(magic, bzip2Magic) && len(magic) > 3 && magic[3] >= '1' && magic[3] <= '9':
+		log.Printf("INFO: %s appears to be bzip2 compressed", filename)
+		return compressionBzip2, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		log.Printf("INFO: %s appears to be zstd compressed", filename)
+		return compressionZstd, nil
+	}
+
+	return compressionNone, nil
+}
+
+func (dr *decompressReader) Close() error {
+
+	var err error
+	for _, c := range dr.closers {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	dr.closers = nil
+	return err
+}
+
+//
+// end of file
+//
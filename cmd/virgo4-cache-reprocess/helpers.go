@@ -1,6 +1,13 @@
 package main
 
-import "log"
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// the key used in per source (or per type) configuration for an entry that applies to anything without its own
+var anyKey = "*"
 
 func fatalIfError(err error) {
 	if err != nil {
@@ -8,6 +15,44 @@ func fatalIfError(err error) {
 	}
 }
 
+// an entry from a key=value configuration spec
+type keyValue struct {
+	key   string
+	value string
+}
+
+// parse a space separated list of key=value entries, in order. Malformed entries are reported as errBad with the
+// shape describing a well formed one. If valueOptional is set an entry may be just the key, with an empty value
+func parseKeyValueSpec(spec string, errBad error, shape string, valueOptional bool) ([]keyValue, error) {
+
+	entries := make([]keyValue, 0)
+	for _, entry := range strings.Fields(spec) {
+
+		tokens := strings.SplitN(entry, "=", 2)
+		kv := keyValue{key: tokens[0]}
+		if len(tokens) == 2 {
+			kv.value = tokens[1]
+		}
+
+		if len(kv.key) == 0 || (len(kv.value) == 0 && (valueOptional == false || len(tokens) == 2)) {
+			return nil, fmt.Errorf("%w: [%s] is not %s", errBad, entry, shape)
+		}
+		entries = append(entries, kv)
+	}
+
+	return entries, nil
+}
+
+// is the value in the slice
+func contains(slice []string, value string) bool {
+	for _, item := range slice {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
 //
 // end of file
 //
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNoHistory - a historical payload was requested but the cache history is not available
+var ErrNoHistory = fmt.Errorf("cache history is not configured")
+
+// the time formats accepted for an as of time
+var asOfFormats = []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"}
+
+// the maximum number of history keys to select at once
+var historyMaxKeyCount = 500
+
+// a request for the historical payload of an id
+type historyKey struct {
+	id      string
+	version int       // the version to select, zero to select by time
+	asOf    time.Time // select the latest version written at or before this time
+}
+
+func historyKeyFor(rec Record) historyKey {
+	return historyKey{id: rec.Id(), version: rec.Version(), asOf: rec.AsOf()}
+}
+
+// historySelection - a description of the history selection for use in a key, empty for the current payload
+func historySelection(rec Record) string {
+	if rec.Version() != 0 {
+		return fmt.Sprintf("v%d", rec.Version())
+	}
+	if rec.AsOf().IsZero() == false {
+		return rec.AsOf().UTC().Format(time.RFC3339Nano)
+	}
+	return ""
+}
+
+// isHistorical - does the record select a historical payload rather than the current one
+func isHistorical(rec Record) bool {
+	return rec.Version() != 0 || rec.AsOf().IsZero() == false
+}
+
+// parse the optional history selection from an input record, at most one of version and as of can be specified
+func parseHistorySelection(version string, asOf string) (int, time.Time, error) {
+
+	version = strings.TrimSpace(version)
+	asOf = strings.TrimSpace(asOf)
+
+	if len(version) != 0 && len(asOf) != 0 {
+		return 0, time.Time{}, badRecord("specify a version or an as of time, not both")
+	}
+
+	if len(version) != 0 {
+		v, err := strconv.Atoi(version)
+		if err != nil || v <= 0 {
+			return 0, time.Time{}, badRecord("invalid version [%s]", version)
+		}
+		return v, time.Time{}, nil
+	}
+
+	if len(asOf) != 0 {
+		for _, format := range asOfFormats {
+			if t, err := time.Parse(format, asOf); err == nil {
+				return 0, t, nil
+			}
+		}
+		return 0, time.Time{}, badRecord("invalid as of time [%s]", asOf)
+	}
+
+	return 0, time.Time{}, nil
+}
+
+// describe the history selection for logging
+func historyDescription(rec Record) string {
+	if rec.Version() != 0 {
+		return fmt.Sprintf("version %d", rec.Version())
+	}
+	return fmt.Sprintf("as of %s", rec.AsOf().Format(time.RFC3339))
+}
+
+//
+// end of file
+//
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ErrBadIdRule - the id rule configuration is invalid
+var ErrBadIdRule = fmt.Errorf("bad id rule configuration")
+
+// the prefix used to specify a regular expression rule rather than a named one
+var idRuleRegexPrefix = "regex:"
+
+// the rule used for sources without one, accepts anything
+var anyIdRule = regexp.MustCompile(`.*`)
+
+// the named rules we support
+var namedIdRules = map[string]string{
+	"u-number":      `^u[0-9]+$`,
+	"numeric":       `^[0-9]+$`,
+	"alphanumeric":  `^[A-Za-z0-9]+$`,
+	"no-whitespace": `^\S+$`,
+}
+
+// IdRules - the id syntax rules for each data source
+type IdRules map[string]*regexp.Regexp
+
+// ParseIdRules - parse a space separated list of source=rule entries where rule is either a named rule
+// or a regular expression prefixed with "regex:"
+func ParseIdRules(spec string) (IdRules, error) {
+
+	entries, err := parseKeyValueSpec(spec, ErrBadIdRule, "source=rule", false)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make(IdRules)
+	for _, entry := range entries {
+
+		pattern := entry.value
+		if strings.HasPrefix(pattern, idRuleRegexPrefix) {
+			pattern = strings.TrimPrefix(pattern, idRuleRegexPrefix)
+		} else {
+			named, found := namedIdRules[pattern]
+			if found == false {
+				return nil, fmt.Errorf("%w: unknown rule [%s]", ErrBadIdRule, pattern)
+			}
+			pattern = named
+		}
+
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrBadIdRule, err.Error())
+		}
+		rules[entry.key] = re
+	}
+
+	return rules, nil
+}
+
+// Check - check the record id syntax. Records without a source are acceptable if the id is valid for any
+// of the default sources
+func (r IdRules) Check(rec Record, defaultSources []string) error {
+
+	if len(r) == 0 {
+		return nil
+	}
+
+	sources := defaultSources
+	if len(rec.Source()) != 0 {
+		sources = []string{rec.Source()}
+	}
+
+	for _, source := range sources {
+		if r.rule(source).MatchString(rec.Id()) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("id syntax is invalid for source(s) [%s]", strings.Join(sources, " "))
+}
+
+// the rule for the specified source, a source without a rule accepts anything
+func (r IdRules) rule(source string) *regexp.Regexp {
+
+	if re, found := r[source]; found == true {
+		return re
+	}
+	if re, found := r[anyKey]; found == true {
+		return re
+	}
+	return anyIdRule
+}
+
+//
+// end of file
+//
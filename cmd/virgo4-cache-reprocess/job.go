@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// ErrBadJob - the job definition is invalid
+var ErrBadJob = fmt.Errorf("bad job definition")
+
+// job definition files are identified by this suffix
+var jobFileSuffix = ".job.json"
+
+// the job types we support
+var jobTypeReindex = "reindex"
+var jobTypeIncremental = "incremental"
+
+// JobDefinition - a job that selects records directly from the cache rather than from an input file
+type JobDefinition struct {
+	Type    string   `json:"type"`    // the job type
+	Sources []string `json:"sources"` // the data sources to process
+	Types   []string `json:"types"`   // optional, the record types to process
+
+	// incremental jobs only
+	Column    string    `json:"column"`    // optional, the update timestamp column (overrides the configured one)
+	Since     time.Time `json:"since"`     // records updated at or after this time, optional if using a watermark
+	Until     time.Time `json:"until"`     // optional, records updated before this time
+	Watermark string    `json:"watermark"` // optional, the name of the watermark to start from and update
+
+	// optional, transforms applied to every record after any configured for its source. Only job definitions can
+	// carry transforms, records from an id file only get the configured per source transforms
+	Transforms []TransformDefinition `json:"transforms"`
+	transforms []PayloadTransform
+
+	lag time.Duration // how far behind the cache clock an open ended run stops
+}
+
+// isJobFile - is this the name of a job definition file
+func isJobFile(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), jobFileSuffix)
+}
+
+// LoadJobDefinition - load and validate a job definition file
+func LoadJobDefinition(filename string, config *ServiceConfig) (*JobDefinition, error) {
+
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var job JobDefinition
+	err = json.Unmarshal(buf, &job)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadJob, err.Error())
+	}
+
+	if job.Type == jobTypeIncremental && len(job.Column) == 0 {
+		job.Column = config.PostgresUpdatedColumn
+	}
+
+	err = job.validate(config)
+	if err != nil {
+		return nil, err
+	}
+
+	job.transforms, err = NewPayloadTransforms(job.Transforms)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadJob, err.Error())
+	}
+	job.lag = time.Duration(config.WatermarkLag) * time.Second
+
+	return &job, nil
+}
+
+// Run - run the job sending the prepared records to the outbound channel, returns the number of records selected
+func (j *JobDefinition) Run(cache CacheProxy, watermarks WatermarkStore, stage *OutboundStage, outbound chan<- awssqs.Message) (int, error) {
+
+	sink := func(message *awssqs.Message) error {
+		send, err := stage.Prepare(message, j.transforms)
+		if err != nil {
+			return err
+		}
+		if send == true {
+			outbound <- *message
+		}
+		return nil
+	}
+
+	filter := CacheFilter{Sources: j.Sources, Types: j.Types}
+	if j.Type != jobTypeIncremental {
+		return cache.Stream(filter, sink)
+	}
+
+	filter.UpdatedColumn = j.Column
+	filter.Since = j.Since
+	filter.Until = j.Until
+
+	// the watermark, if it exists, takes the place of the since time
+	var current time.Time
+	if len(j.Watermark) != 0 {
+		watermark, found, err := watermarks.Get(j.Watermark)
+		if err != nil {
+			return 0, err
+		}
+		if found == true {
+			current = watermark
+			log.Printf("INFO: watermark %s is %s", j.Watermark, watermark.Format(time.RFC3339))
+			filter.Since = watermark
+		} else {
+			// with no since time either, this first run processes everything
+			log.Printf("INFO: watermark %s does not exist yet", j.Watermark)
+		}
+	}
+
+	// if there is no end time we process up to the cache clock, less the lag so rows committed late with an
+	// earlier timestamp are still in range next time. Anything updated while we run will be picked up next time
+	if filter.Until.IsZero() {
+		now, err := cache.Now()
+		if err != nil {
+			return 0, err
+		}
+		filter.Until = now.Add(-j.lag)
+	}
+
+	// a watermark already past the end of the range leaves nothing to do, and must not be moved backwards
+	if filter.Since.Before(filter.Until) == false {
+		log.Printf("INFO: nothing to select, %s is not before %s", filter.Since.Format(time.RFC3339), filter.Until.Format(time.RFC3339))
+		return 0, nil
+	}
+
+	log.Printf("INFO: selecting records where %s in [%s, %s)", filter.UpdatedColumn,
+		filter.Since.Format(time.RFC3339), filter.Until.Format(time.RFC3339))
+
+	count, err := cache.Stream(filter, sink)
+	if err != nil {
+		return count, err
+	}
+
+	if len(j.Watermark) != 0 && filter.Until.After(current) == true {
+		err = watermarks.Put(j.Watermark, filter.Until)
+		if err != nil {
+			return count, err
+		}
+		log.Printf("INFO: watermark %s updated to %s", j.Watermark, filter.Until.Format(time.RFC3339))
+	}
+
+	return count, nil
+}
+
+// String - a description for logging
+func (j *JobDefinition) String() string {
+	desc := fmt.Sprintf("%s job, sources [%s]", j.Type, strings.Join(j.Sources, " "))
+	if len(j.Types) != 0 {
+		desc += fmt.Sprintf(", types [%s]", strings.Join(j.Types, " "))
+	}
+	if len(j.Watermark) != 0 {
+		desc += fmt.Sprintf(", watermark %s", j.Watermark)
+	}
+	if len(j.Transforms) != 0 {
+		desc += fmt.Sprintf(", %d transform(s)", len(j.Transforms))
+	}
+	return desc
+}
+
+func (j *JobDefinition) validate(config *ServiceConfig) error {
+
+	switch j.Type {
+	case jobTypeReindex:
+		if len(j.Sources) == 0 {
+			return fmt.Errorf("%w: %s job requires one or more sources", ErrBadJob, j.Type)
+		}
+	case jobTypeIncremental:
+		if len(j.Sources) == 0 {
+			return fmt.Errorf("%w: %s job requires one or more sources", ErrBadJob, j.Type)
+		}
+		if len(j.Column) == 0 {
+			return fmt.Errorf("%w: %s job requires an update column", ErrBadJob, j.Type)
+		}
+		if j.Since.IsZero() && len(j.Watermark) == 0 {
+			return fmt.Errorf("%w: %s job requires a since time or a watermark", ErrBadJob, j.Type)
+		}
+		if j.Until.IsZero() == false && j.Until.After(j.Since) == false {
+			return fmt.Errorf("%w: until time must be after the since time", ErrBadJob)
+		}
+		if len(j.Watermark) != 0 && len(config.WatermarkBucket) == 0 {
+			return fmt.Errorf("%w: watermarks are not configured", ErrBadJob)
+		}
+	default:
+		return fmt.Errorf("%w: unsupported job type [%s]", ErrBadJob, j.Type)
+	}
+
+	// an unknown source would silently process nothing
+	configured := strings.Fields(config.DataSourceNames)
+	for _, source := range j.Sources {
+		if contains(configured, source) == false {
+			return fmt.Errorf("%w: unknown source [%s]", ErrBadJob, source)
+		}
+	}
+
+	return nil
+}
+
+//
+// end of file
+//
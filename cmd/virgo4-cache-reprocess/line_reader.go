@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// ParsePolicy - how tolerant we are of the lines in an input file
+type ParsePolicy struct {
+	TrimWhitespace bool   // trim leading and trailing whitespace (including CR) from each line
+	SkipBlank      bool   // skip blank lines rather than treating them as bad records
+	CommentPrefix  string // skip lines beginning with this prefix, empty to disable
+}
+
+// SkippedLines - the lines ignored because of the parse policy
+type SkippedLines struct {
+	Blank   int `json:"blank"`
+	Comment int `json:"comment"`
+}
+
+// reads lines from the input stream applying the parse policy
+type lineReader struct {
+	reader  *bufio.Reader
+	policy  ParsePolicy
+	lineNo  int    // the line number of the last line read (1 based)
+	raw     string // the content of the last line read, before any trimming
+	skipped SkippedLines
+}
+
+func newLineReader(reader *bufio.Reader, policy ParsePolicy) *lineReader {
+	return &lineReader{reader: reader, policy: policy}
+}
+
+// read the next line that is not skipped by the policy, returns io.EOF when there are no more lines
+func (lr *lineReader) ReadLine() (string, error) {
+
+	for {
+		line, err := lr.reader.ReadString('\n')
+		if err != nil {
+			// if we encounter end of file, we might have actually read a line check to see if we did
+			if err == io.EOF {
+				if len(line) == 0 {
+					return "", err
+				}
+			} else {
+				return "", err
+			}
+		}
+		lr.lineNo++
+
+		// remove the newline
+		line = strings.TrimSuffix(line, "\n")
+		lr.raw = line
+		if lr.policy.TrimWhitespace == true {
+			line = strings.TrimSpace(line)
+		}
+
+		if len(line) == 0 && lr.policy.SkipBlank == true {
+			lr.skipped.Blank++
+			continue
+		}
+
+		if len(lr.policy.CommentPrefix) != 0 && strings.HasPrefix(line, lr.policy.CommentPrefix) {
+			lr.skipped.Comment++
+			continue
+		}
+
+		return line, nil
+	}
+}
+
+// the line number of the last line returned
+func (lr *lineReader) LineNumber() int {
+	return lr.lineNo
+}
+
+// the raw content of the last line read
+func (lr *lineReader) RawLine() string {
+	return lr.raw
+}
+
+// the lines we have skipped so far
+func (lr *lineReader) Skipped() SkippedLines {
+	return lr.skipped
+}
+
+//
+// end of file
+//
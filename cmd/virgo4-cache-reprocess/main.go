@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path"
 	"time"
 
 	"github.com/uvalib/uva-aws-s3-sdk/uva-s3"
@@ -18,6 +19,7 @@ var flushTimeout = 5 * time.Second
 type NameTuple struct {
 	LocalName  string
 	RemoteName string
+	Job        *JobDefinition // set if the file is a job definition rather than a list of records
 }
 
 // main entry point
@@ -46,6 +48,14 @@ func main() {
 	cacheProxy, err := NewCacheProxy(cfg)
 	fatalIfError(err)
 
+	// the per source payload transforms and per type validation, applied before anything is sent
+	transformer, err := NewTransformer(cfg)
+	fatalIfError(err)
+	outboundStage := NewOutboundStage(transformer, cfg.PayloadValidator, NewQuarantine(cfg, s3Svc))
+
+	// used by incremental jobs, may be nil if not configured
+	watermarks := NewWatermarkStore(cfg, s3Svc)
+
 	// create the channel of inbound items
 	inboundRecordsChan := make(chan Record, cfg.InboundWorkerQueueSize)
 
@@ -54,7 +64,7 @@ func main() {
 
 	// start cache workers here
 	for w := 1; w <= cfg.CacheWorkers; w++ {
-		go cache_worker(w, cacheProxy, inboundRecordsChan, outboundRecordsChan)
+		go cache_worker(w, cacheProxy, outboundStage, inboundRecordsChan, outboundRecordsChan)
 	}
 
 	// start send workers here
@@ -85,8 +95,8 @@ func main() {
 				continue
 			}
 
-			// create temp file
-			tmp, e := ioutil.TempFile(cfg.DownloadDir, "")
+			// create temp file, keep the original name because the extensions tell us the format and compression
+			tmp, e := ioutil.TempFile(cfg.DownloadDir, "*-"+path.Base(f.SourceKey))
 			fatalIfError(e)
 			tmp.Close()
 			file.LocalName = tmp.Name()
@@ -101,13 +111,36 @@ func main() {
 
 			log.Printf("INFO: validating %s (%s)", file.RemoteName, file.LocalName)
 
+			// job definitions select records directly from the cache rather than listing them
+			if isJobFile(file.RemoteName) {
+				job, e := LoadJobDefinition(file.LocalName, cfg)
+				if e != nil {
+					log.Printf("ERROR: %s (%s) appears to be invalid, ignoring it (%s)", file.RemoteName, file.LocalName, e.Error())
+					err = e
+					break
+				}
+				log.Printf("INFO: %s (%s) defines a %s, ready for processing", file.RemoteName, file.LocalName, job.String())
+				fileSets[len(fileSets)-1].Job = job
+				continue
+			}
+
 			// create a new loader
-			loader, e := NewRecordLoader(file.LocalName)
+			loader, e := NewRecordLoader(file.LocalName, cfg)
 			fatalIfError(e)
 
 			// validate the file and ensure each item appears in the cache
-			e = loader.Validate(cacheProxy)
+			result, e := loader.Validate(cacheProxy)
 			loader.Done()
+			if e == nil {
+				result.Log(file.RemoteName)
+				if len(cfg.ValidationBucket) != 0 {
+					// the report is for people, failing to write it does not change the outcome
+					if se := result.Store(s3Svc, cfg.ValidationBucket, cfg.ValidationPrefix, file.RemoteName); se != nil {
+						log.Printf("ERROR: %s", se.Error())
+					}
+				}
+				e = result.Error()
+			}
 			if e == nil {
 				log.Printf("INFO: %s (%s) appears to be OK, ready for ingest", file.RemoteName, file.LocalName)
 			} else {
@@ -154,13 +187,30 @@ func main() {
 			start := time.Now()
 			log.Printf("INFO: processing %s (%s)", file.RemoteName, file.LocalName)
 
-			loader, err := NewRecordLoader(file.LocalName)
+			// jobs stream directly from the cache to the send workers
+			if file.Job != nil {
+				quarantined := outboundStage.Quarantined()
+				count, err := file.Job.Run(cacheProxy, watermarks, outboundStage, outboundRecordsChan)
+				fatalIfError(err)
+				quarantined = outboundStage.Quarantined() - quarantined
+
+				duration := time.Since(start)
+				log.Printf("INFO: done processing %s (%s). %d records, %d quarantined (%0.2f tps)", file.RemoteName, file.LocalName, count, quarantined, float64(count)/duration.Seconds())
+
+				log.Printf("INFO: removing processed file %s", file.LocalName)
+				err = os.Remove(file.LocalName)
+				fatalIfError(err)
+				continue
+			}
+
+			loader, err := NewRecordLoader(file.LocalName, cfg)
 			// fatal fail here because we have already validated the file and believe it to be correct so this
 			// is some other sort of failure
 			fatalIfError(err)
 
 			// get the first record
 			count := 0
+			dedup := newRecordDeduplicator(cfg.DedupMaxKeys)
 			rec, err := loader.First()
 			if err != nil {
 				// are we done
@@ -176,8 +226,14 @@ func main() {
 			// we can get here with an error if the first read yields EOF
 			if err == nil {
 				for {
-					count++
-					inboundRecordsChan <- rec
+					// an id can appear more than once in a file, we only process it once
+					seen, e := dedup.Seen(rec)
+					// fatal fail here because we have already validated the file so there are no conflicts
+					fatalIfError(e)
+					if seen == false {
+						count++
+						inboundRecordsChan <- rec
+					}
 
 					rec, err = loader.Next()
 					if err != nil {
@@ -192,9 +248,10 @@ func main() {
 				}
 			}
 
+			reportSkipped(file, loader.Skipped())
 			loader.Done()
 			duration := time.Since(start)
-			log.Printf("INFO: done processing %s (%s). %d records (%0.2f tps)", file.RemoteName, file.LocalName, count, float64(count)/duration.Seconds())
+			log.Printf("INFO: done processing %s (%s). %d records, %d duplicates ignored (%0.2f tps)", file.RemoteName, file.LocalName, count, dedup.Duplicates(), float64(count)/duration.Seconds())
 
 			// file has been ingested, remove it
 			log.Printf("INFO: removing processed file %s", file.LocalName)
@@ -204,6 +261,14 @@ func main() {
 	}
 }
 
+// report any lines ignored because of the parse policy
+func reportSkipped(file NameTuple, skipped SkippedLines) {
+
+	if skipped.Blank != 0 || skipped.Comment != 0 {
+		log.Printf("INFO: %s (%s) skipped %d blank and %d comment line(s)", file.RemoteName, file.LocalName, skipped.Blank, skipped.Comment)
+	}
+}
+
 //
 // end of file
 //
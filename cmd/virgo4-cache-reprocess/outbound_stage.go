@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// OutboundStage - everything that happens to a message between the cache and the outbound queue. Messages are
+// transformed and then validated, those that fail either step are quarantined rather than sent
+type OutboundStage struct {
+	transformer *Transformer
+	validator   PayloadValidator
+	quarantine  Quarantine
+}
+
+// NewOutboundStage - our factory
+func NewOutboundStage(transformer *Transformer, validator PayloadValidator, quarantine Quarantine) *OutboundStage {
+	return &OutboundStage{transformer: transformer, validator: validator, quarantine: quarantine}
+}
+
+// Prepare - prepare the message for sending applying any additional transforms (e.g. from a job). Returns false if
+// the message was quarantined and should not be sent. An error means the message could not be quarantined
+func (s *OutboundStage) Prepare(message *awssqs.Message, transforms []PayloadTransform) (bool, error) {
+
+	err := s.transformer.Apply(message, transforms)
+	if err == nil {
+		err = s.validator.Check(message)
+	}
+
+	if err == nil {
+		return true, nil
+	}
+
+	if errors.Is(err, ErrTransformFailed) == false && errors.Is(err, ErrInvalidPayload) == false {
+		return false, err
+	}
+
+	return false, s.quarantine.Add(message, err)
+}
+
+// Quarantined - the number of messages quarantined so far
+func (s *OutboundStage) Quarantined() int {
+	return s.quarantine.Count()
+}
+
+//
+// end of file
+//
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// ErrBadPayloadCompression - the payload compression configuration is invalid
+var ErrBadPayloadCompression = fmt.Errorf("bad payload compression configuration")
+
+// ErrUnknownContentEncoding - the payload content encoding marker is not one we understand
+var ErrUnknownContentEncoding = fmt.Errorf("unknown payload content encoding")
+
+// the ways we can handle a compressed payload
+var PayloadCompressionNone = "none"               // send the payload verbatim
+var PayloadCompressionDecompress = "decompress"   // decompress compressed payloads before sending
+var PayloadCompressionPassthrough = "passthrough" // send compressed payloads as is, marked with an attribute
+
+// the attribute used to mark a passed through compressed payload. SQS message bodies must be text so the
+// payload is also base64 encoded
+var attributeKeyContentEncoding = "content-encoding"
+var contentEncodingSuffix = "+base64"
+
+// PayloadCompression - how compressed payloads are handled for each data source
+type PayloadCompression map[string]string
+
+// ParsePayloadCompression - parse a space separated list of source=mode entries. The source "*" applies to any
+// source without its own entry
+func ParsePayloadCompression(spec string) (PayloadCompression, error) {
+
+	entries, err := parseKeyValueSpec(spec, ErrBadPayloadCompression, "source=mode", false)
+	if err != nil {
+		return nil, err
+	}
+
+	pc := make(PayloadCompression)
+	for _, entry := range entries {
+
+		switch entry.value {
+		case PayloadCompressionNone, PayloadCompressionDecompress, PayloadCompressionPassthrough:
+			pc[entry.key] = entry.value
+		default:
+			return nil, fmt.Errorf("%w: unknown mode [%s]", ErrBadPayloadCompression, entry.value)
+		}
+	}
+
+	return pc, nil
+}
+
+// the mode for the specified source
+func (pc PayloadCompression) mode(source string) string {
+
+	if mode, found := pc[source]; found == true {
+		return mode
+	}
+	if mode, found := pc[anyKey]; found == true {
+		return mode
+	}
+	return PayloadCompressionNone
+}
+
+// decode the payload from the specified source according to its mode, returns the payload to send and any
+// additional attributes
+func (pc PayloadCompression) decode(source string, payload string, encoding string) (string, []awssqs.Attribute, error) {
+
+	mode := pc.mode(source)
+	if mode == PayloadCompressionNone {
+		return payload, nil, nil
+	}
+
+	compression, err := payloadCompression(payload, encoding)
+	if err != nil {
+		return "", nil, err
+	}
+	if compression == compressionNone {
+		return payload, nil, nil
+	}
+
+	if mode == PayloadCompressionPassthrough {
+		attribute := awssqs.Attribute{Name: attributeKeyContentEncoding, Value: compression + contentEncodingSuffix}
+		return base64.StdEncoding.EncodeToString([]byte(payload)), []awssqs.Attribute{attribute}, nil
+	}
+
+	decompressed, err := decompressPayload(compression, payload)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot decompress %s payload: %s", compression, err.Error())
+	}
+	return decompressed, nil, nil
+}
+
+// determine the payload compression, from the content encoding marker if there is one or the magic bytes if not.
+// A marker we do not understand is an error rather than risk sending a payload nobody can read
+func payloadCompression(payload string, encoding string) (string, error) {
+
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		return compressionGzip, nil
+	case "zstd":
+		return compressionZstd, nil
+	case "identity":
+		return compressionNone, nil
+	case "":
+		// no marker, look at the payload
+	default:
+		return "", fmt.Errorf("%w [%s]", ErrUnknownContentEncoding, encoding)
+	}
+
+	switch {
+	case strings.HasPrefix(payload, string(gzipMagic)):
+		return compressionGzip, nil
+	case strings.HasPrefix(payload, string(zstdMagic)):
+		return compressionZstd, nil
+	}
+
+	return compressionNone, nil
+}
+
+func decompressPayload(compression string, payload string) (string, error) {
+
+	switch compression {
+	case compressionGzip:
+		gz, err := gzip.NewReader(strings.NewReader(payload))
+		if err != nil {
+			return "", err
+		}
+		defer gz.Close()
+		buf, err := ioutil.ReadAll(gz)
+		return string(buf), err
+
+	case compressionZstd:
+		zs, err := zstd.NewReader(nil)
+		if err != nil {
+			return "", err
+		}
+		defer zs.Close()
+		buf, err := zs.DecodeAll([]byte(payload), nil)
+		return string(buf), err
+	}
+
+	return "", fmt.Errorf("unsupported compression %s", compression)
+}
+
+//
+// end of file
+//
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// ErrBadPayloadValidation - the payload validation configuration is invalid
+var ErrBadPayloadValidation = fmt.Errorf("bad payload validation configuration")
+
+// ErrInvalidPayload - the payload failed validation
+var ErrInvalidPayload = fmt.Errorf("invalid payload")
+
+// the payload checks we support
+var payloadCheckNonEmpty = "non-empty"
+var payloadCheckXML = "xml"
+var payloadCheckJSON = "json"
+var payloadCheckMaxSizePrefix = "max-size:"
+
+// a single payload check, returns a description of the problem or an empty string if the payload is OK
+type payloadCheck func([]byte) string
+
+// PayloadValidator - the payload checks for each record type
+type PayloadValidator map[string][]payloadCheck
+
+// ParsePayloadValidation - parse a space separated list of type=check[,check...] entries where check is one of
+// non-empty, xml, json or max-size:bytes. The type "*" applies to any type without its own entry
+func ParsePayloadValidation(spec string) (PayloadValidator, error) {
+
+	entries, err := parseKeyValueSpec(spec, ErrBadPayloadValidation, "type=check[,check...]", false)
+	if err != nil {
+		return nil, err
+	}
+
+	pv := make(PayloadValidator)
+	for _, entry := range entries {
+
+		checks := make([]payloadCheck, 0)
+		for _, name := range strings.Split(entry.value, ",") {
+			check, err := newPayloadCheck(name)
+			if err != nil {
+				return nil, err
+			}
+			checks = append(checks, check)
+		}
+		pv[entry.key] = checks
+	}
+
+	return pv, nil
+}
+
+func newPayloadCheck(name string) (payloadCheck, error) {
+
+	switch name {
+	case payloadCheckNonEmpty:
+		return checkNonEmpty, nil
+	case payloadCheckXML:
+		return checkXML, nil
+	case payloadCheckJSON:
+		return checkJSON, nil
+	}
+
+	if strings.HasPrefix(name, payloadCheckMaxSizePrefix) {
+		limit, err := strconv.Atoi(strings.TrimPrefix(name, payloadCheckMaxSizePrefix))
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("%w: [%s] is not a valid size limit", ErrBadPayloadValidation, name)
+		}
+		return func(payload []byte) string {
+			if len(payload) > limit {
+				return fmt.Sprintf("payload is %d bytes, the limit is %d", len(payload), limit)
+			}
+			return ""
+		}, nil
+	}
+
+	return nil, fmt.Errorf("%w: unknown check [%s]", ErrBadPayloadValidation, name)
+}
+
+// Check - check the message payload against the checks for its type. Deletes and compressed payloads are
+// not checked
+func (pv PayloadValidator) Check(message *awssqs.Message) error {
+
+	checks, found := pv[messageAttribute(message, awssqs.AttributeKeyRecordType)]
+	if found == false {
+		checks = pv[anyKey]
+	}
+	if len(checks) == 0 {
+		return nil
+	}
+
+	if messageAttribute(message, awssqs.AttributeKeyRecordOperation) == awssqs.AttributeValueRecordOperationDelete ||
+		len(messageAttribute(message, attributeKeyContentEncoding)) != 0 {
+		return nil
+	}
+
+	for _, check := range checks {
+		if problem := check(message.Payload); len(problem) != 0 {
+			return fmt.Errorf("%w: %s", ErrInvalidPayload, problem)
+		}
+	}
+
+	return nil
+}
+
+func checkNonEmpty(payload []byte) string {
+	if len(strings.TrimSpace(string(payload))) == 0 {
+		return "payload is empty"
+	}
+	return ""
+}
+
+// the payload must be a single well formed XML document
+func checkXML(payload []byte) string {
+
+	decoder := xml.NewDecoder(bytes.NewReader(payload))
+	depth := 0
+	roots := 0
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Sprintf("payload is not well formed XML: %s", err.Error())
+		}
+
+		switch token.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				roots++
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+		}
+	}
+
+	if roots != 1 {
+		return fmt.Sprintf("payload has %d root elements, expected 1", roots)
+	}
+	return ""
+}
+
+func checkJSON(payload []byte) string {
+	if json.Valid(payload) == false {
+		return "payload is not valid JSON"
+	}
+	return ""
+}
+
+//
+// end of file
+//
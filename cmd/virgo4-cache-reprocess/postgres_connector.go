@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+// a connector that builds the connection string each time a connection is opened so credentials mounted from
+// files (and rotated underneath us) are picked up by new connections
+type postgresConnector struct {
+	config   *ServiceConfig
+	database string
+
+	mutex    sync.Mutex
+	lastUser string // the credentials used for the previous connection so we can note rotation
+	lastPass string
+}
+
+func newPostgresConnector(config *ServiceConfig, database string) (*postgresConnector, error) {
+
+	pc := &postgresConnector{config: config, database: database}
+
+	// make sure the credentials are readable now rather than when the first connection is opened
+	_, _, err := pc.credentials()
+	if err != nil {
+		return nil, err
+	}
+
+	return pc, nil
+}
+
+func (pc *postgresConnector) Connect(ctx context.Context) (driver.Conn, error) {
+
+	connStr, err := pc.connectionString()
+	if err != nil {
+		return nil, err
+	}
+
+	connector, err := pq.NewConnector(connStr)
+	if err != nil {
+		return nil, err
+	}
+
+	return connector.Connect(ctx)
+}
+
+func (pc *postgresConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+// build the connection string using the current credentials
+func (pc *postgresConnector) connectionString() (string, error) {
+
+	user, pass, err := pc.credentials()
+	if err != nil {
+		return "", err
+	}
+
+	params := []string{
+		fmt.Sprintf("user=%s", quoteConnValue(user)),
+		fmt.Sprintf("password=%s", quoteConnValue(pass)),
+		fmt.Sprintf("dbname=%s", quoteConnValue(pc.database)),
+		fmt.Sprintf("host=%s", quoteConnValue(pc.config.PostgresHost)),
+		fmt.Sprintf("port=%d", pc.config.PostgresPort),
+		fmt.Sprintf("connect_timeout=%d", pc.config.PostgresConnectTimeout),
+	}
+
+	// when not specified we get the driver default
+	if len(pc.config.PostgresSSLMode) != 0 {
+		params = append(params, fmt.Sprintf("sslmode=%s", quoteConnValue(pc.config.PostgresSSLMode)))
+	}
+	if len(pc.config.PostgresSSLRootCert) != 0 {
+		params = append(params, fmt.Sprintf("sslrootcert=%s", quoteConnValue(pc.config.PostgresSSLRootCert)))
+	}
+
+	return strings.Join(params, " "), nil
+}
+
+// the current credentials, from the mounted files if configured or the environment if not
+func (pc *postgresConnector) credentials() (string, string, error) {
+
+	user := pc.config.PostgresUser
+	pass := pc.config.PostgresPass
+
+	var err error
+	if len(pc.config.PostgresUserFile) != 0 {
+		user, err = readCredentialFile(pc.config.PostgresUserFile)
+		if err != nil {
+			return "", "", err
+		}
+	}
+	if len(pc.config.PostgresPassFile) != 0 {
+		pass, err = readCredentialFile(pc.config.PostgresPassFile)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	if len(pc.lastUser) != 0 && (user != pc.lastUser || pass != pc.lastPass) {
+		log.Printf("INFO: postgres credentials have changed, new connections will use them")
+	}
+	pc.lastUser = user
+	pc.lastPass = pass
+
+	return user, pass, nil
+}
+
+// read a credential from a file ignoring any surrounding whitespace (mounted secrets often end with a newline)
+func readCredentialFile(filename string) (string, error) {
+
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+
+	value := strings.TrimSpace(string(buf))
+	if len(value) == 0 {
+		return "", fmt.Errorf("credential file %s is empty", filename)
+	}
+
+	return value, nil
+}
+
+// quote a connection string value so it can contain spaces, quotes and backslashes
+func quoteConnValue(value string) string {
+
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
+}
+
+//
+// end of file
+//
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uvalib/uva-aws-s3-sdk/uva-s3"
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// Quarantine - records that cannot be sent are reported here rather than going to the outbound queue
+type Quarantine interface {
+	Add(*awssqs.Message, error) error
+	Count() int // the number of records quarantined since we started
+}
+
+// QuarantineEntry - a quarantined record, as written to the quarantine report
+type QuarantineEntry struct {
+	Id         string            `json:"id"`
+	Source     string            `json:"source"`
+	Type       string            `json:"type"`
+	Reason     string            `json:"reason"`
+	When       time.Time         `json:"when"`
+	Attributes map[string]string `json:"attributes"`
+	Payload    string            `json:"payload"`
+}
+
+// our implementation, every record is logged and, if a bucket is configured, a report of each one is written to S3
+type quarantineImpl struct {
+	s3     uva_s3.UvaS3
+	bucket string
+	prefix string
+
+	mutex sync.Mutex
+	count int
+}
+
+// NewQuarantine - our factory
+func NewQuarantine(config *ServiceConfig, s3 uva_s3.UvaS3) Quarantine {
+	return &quarantineImpl{s3: s3, bucket: config.QuarantineBucket, prefix: config.QuarantinePrefix}
+}
+
+func (q *quarantineImpl) Add(message *awssqs.Message, reason error) error {
+
+	entry := QuarantineEntry{
+		Id:         messageAttribute(message, awssqs.AttributeKeyRecordId),
+		Source:     messageAttribute(message, awssqs.AttributeKeyRecordSource),
+		Type:       messageAttribute(message, awssqs.AttributeKeyRecordType),
+		Reason:     reason.Error(),
+		When:       time.Now().UTC(),
+		Attributes: make(map[string]string, len(message.Attribs)),
+		Payload:    string(message.Payload),
+	}
+	for _, a := range message.Attribs {
+		entry.Attributes[a.Name] = a.Value
+	}
+
+	q.mutex.Lock()
+	q.count++
+	q.mutex.Unlock()
+
+	log.Printf("WARNING: quarantined id %s from %s: %s", entry.Id, entry.Source, entry.Reason)
+	if len(q.bucket) == 0 {
+		return nil
+	}
+
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	o := uva_s3.NewUvaS3Object(q.bucket, q.key(entry))
+	err = q.s3.PutFromBuffer(o, buf)
+	if err != nil {
+		return fmt.Errorf("writing quarantine report for id %s: %s", entry.Id, err.Error())
+	}
+
+	return nil
+}
+
+func (q *quarantineImpl) Count() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.count
+}
+
+// one object per record, grouped by source and named so reports for the same id sort by time
+func (q *quarantineImpl) key(entry QuarantineEntry) string {
+	id := strings.ReplaceAll(entry.Id, "/", "_")
+	return fmt.Sprintf("%s%s/%s-%s.json", q.prefix, entry.Source, id, entry.When.Format("20060102T150405.000000000Z"))
+}
+
+//
+// end of file
+//
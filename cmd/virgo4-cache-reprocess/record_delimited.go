@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// ErrMissingIdColumn - the header row does not include an id column
+var ErrMissingIdColumn = fmt.Errorf("header row does not contain an id column")
+
+// ErrBadHeader - the header row cannot be parsed
+var ErrBadHeader = fmt.Errorf("header row cannot be parsed")
+
+// the column names we understand in the header row
+var delimitedColumnId = "id"
+var delimitedColumnSource = "source"
+var delimitedColumnOperation = "operation"
+var delimitedColumnVersion = "version"
+var delimitedColumnAsOf = "as_of"
+
+// the delimited (CSV/TSV) format, a header row followed by one record per line
+type delimitedDecoder struct {
+	delimiter   rune
+	reader      *lineReader
+	columns     int
+	idIx        int
+	sourceIx    int
+	operationIx int
+	versionIx   int
+	asOfIx      int
+}
+
+func newDelimitedDecoder(delimiter rune) *delimitedDecoder {
+	return &delimitedDecoder{delimiter: delimiter}
+}
+
+// read the header row and locate the columns we are interested in
+func (d *delimitedDecoder) Start(reader *lineReader) error {
+
+	d.reader = reader
+	d.columns = 0
+	d.idIx, d.sourceIx, d.operationIx, d.versionIx, d.asOfIx = -1, -1, -1, -1, -1
+
+	// without a usable header no row can be decoded so this is not just a bad record
+	header, err := d.readFields()
+	if err != nil {
+		if errors.Is(err, ErrBadRecord) == true {
+			return fmt.Errorf("%w: %s", ErrBadHeader, err.Error())
+		}
+		return err
+	}
+
+	d.columns = len(header)
+	for ix, name := range header {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case delimitedColumnId:
+			d.idIx = ix
+		case delimitedColumnSource:
+			d.sourceIx = ix
+		case delimitedColumnOperation:
+			d.operationIx = ix
+		case delimitedColumnVersion:
+			d.versionIx = ix
+		case delimitedColumnAsOf:
+			d.asOfIx = ix
+		default:
+			log.Printf("WARNING: ignoring unrecognized column [%s]", name)
+		}
+	}
+
+	if d.idIx == -1 {
+		return ErrMissingIdColumn
+	}
+
+	return nil
+}
+
+func (d *delimitedDecoder) Decode() (Record, error) {
+
+	if d.reader == nil {
+		return nil, ErrFileNotOpen
+	}
+
+	if d.idIx == -1 {
+		return nil, ErrMissingIdColumn
+	}
+
+	fields, err := d.readFields()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(fields) != d.columns {
+		return nil, badRecord("expected %d columns, got %d", d.columns, len(fields))
+	}
+
+	rec := &recordImpl{RecordId: strings.TrimSpace(fields[d.idIx]), RecordLine: d.reader.LineNumber()}
+	if len(rec.RecordId) == 0 {
+		return nil, badRecord("empty id")
+	}
+
+	if d.sourceIx != -1 {
+		rec.RecordSource = strings.TrimSpace(fields[d.sourceIx])
+	}
+
+	operation := ""
+	if d.operationIx != -1 {
+		operation = fields[d.operationIx]
+	}
+
+	rec.RecordOperation, err = normalizeOperation(operation)
+	if err != nil {
+		return nil, err
+	}
+
+	version, asOf := "", ""
+	if d.versionIx != -1 {
+		version = fields[d.versionIx]
+	}
+	if d.asOfIx != -1 {
+		asOf = fields[d.asOfIx]
+	}
+
+	rec.RecordVersion, rec.RecordAsOf, err = parseHistorySelection(version, asOf)
+	if err != nil {
+		return nil, err
+	}
+
+	return rec, nil
+}
+
+// read the next line and split it into fields. Each record must fit on a single line
+func (d *delimitedDecoder) readFields() ([]string, error) {
+
+	line, err := d.reader.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+
+	r := csv.NewReader(strings.NewReader(line))
+	r.Comma = d.delimiter
+	r.TrimLeadingSpace = true
+	// TSV files are rarely quoted properly
+	r.LazyQuotes = d.delimiter == '\t'
+
+	fields, err := r.Read()
+	if err != nil {
+		return nil, badRecord("%s", err.Error())
+	}
+
+	return fields, nil
+}
+
+// validate the operation and map an empty one to the default
+func normalizeOperation(operation string) (string, error) {
+
+	switch strings.ToLower(strings.TrimSpace(operation)) {
+	case "", awssqs.AttributeValueRecordOperationUpdate:
+		return awssqs.AttributeValueRecordOperationUpdate, nil
+	case awssqs.AttributeValueRecordOperationDelete:
+		return awssqs.AttributeValueRecordOperationDelete, nil
+	}
+
+	return "", badRecord("unsupported record operation [%s]", operation)
+}
+
+//
+// end of file
+//
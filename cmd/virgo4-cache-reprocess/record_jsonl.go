@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// the JSON Lines format, one JSON object per line
+type jsonlDecoder struct {
+	reader *lineReader
+}
+
+// the structure of each line
+type jsonlRecord struct {
+	Id        string `json:"id"`
+	Source    string `json:"source"`
+	Operation string `json:"operation"`
+	Priority  int    `json:"priority"`
+	Note      string `json:"note"`
+	Version   int    `json:"version"` // optional, select a historical payload by version
+	AsOf      string `json:"as_of"`   // optional, or by time
+}
+
+func (d *jsonlDecoder) Start(reader *lineReader) error {
+	d.reader = reader
+	return nil
+}
+
+func (d *jsonlDecoder) Decode() (Record, error) {
+
+	if d.reader == nil {
+		return nil, ErrFileNotOpen
+	}
+
+	line, err := d.reader.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+
+	var jr jsonlRecord
+	err = json.Unmarshal([]byte(line), &jr)
+	if err != nil {
+		return nil, badRecord("json unmarshal: %s", err.Error())
+	}
+
+	rec := &recordImpl{
+		RecordId:       strings.TrimSpace(jr.Id),
+		RecordSource:   strings.TrimSpace(jr.Source),
+		RecordPriority: jr.Priority,
+		RecordNote:     jr.Note,
+		RecordLine:     d.reader.LineNumber(),
+	}
+
+	if len(rec.RecordId) == 0 {
+		return nil, badRecord("empty id")
+	}
+
+	rec.RecordOperation, err = normalizeOperation(jr.Operation)
+	if err != nil {
+		return nil, err
+	}
+
+	version := ""
+	if jr.Version != 0 {
+		version = strconv.Itoa(jr.Version)
+	}
+	rec.RecordVersion, rec.RecordAsOf, err = parseHistorySelection(version, jr.AsOf)
+	if err != nil {
+		return nil, err
+	}
+
+	return rec, nil
+}
+
+//
+// end of file
+//
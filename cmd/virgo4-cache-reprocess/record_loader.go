@@ -2,135 +2,244 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
 )
 
 // ErrBadRecord - the record is bad
 var ErrBadRecord = fmt.Errorf("bad record encountered")
 
+// ErrValidationFailed - the file contains bad records or records that are not in the cache
+var ErrValidationFailed = fmt.Errorf("file failed validation")
+
 // ErrFileNotOpen - the file is not open
 var ErrFileNotOpen = fmt.Errorf("file is not open")
 
 // RecordLoader - our interface
 type RecordLoader interface {
-	Validate(CacheProxy) error
+	Validate(CacheProxy) (*ValidationResult, error)
 	First() (Record, error)
 	Next() (Record, error)
+	Skipped() SkippedLines
 	Done()
 }
 
 // Record - the record interface
 type Record interface {
 	Id() string
+	Source() string    // empty if the record can come from any of the configured data sources
+	Operation() string // one of the awssqs record operation values
+	Priority() int     // zero if not specified
+	Note() string      // empty if not specified
+	Version() int      // the historical payload version, zero for the current payload
+	AsOf() time.Time   // the time of the historical payload, zero for the current payload
+	Line() int         // the line number in the input file
 	//Raw() []byte
 }
 
+// recordDecoder - decodes records of a specific format from the input stream
+type recordDecoder interface {
+	Start(*lineReader) error // called each time we begin reading from the start of the stream
+	Decode() (Record, error)
+}
+
 // this is our loader implementation
 type recordLoaderImpl struct {
-	File   *os.File
-	Reader *bufio.Reader
+	FileName string
+	File     *decompressReader
+	Reader   *lineReader
+	Decoder  recordDecoder
+	Policy   ParsePolicy
+
+	ErrorLimit        int      // the maximum number of validation problems to report
+	ValidationWorkers int      // the number of concurrent cache lookups during validation
+	IdRules           IdRules  // the id syntax rules
+	DefaultSources    []string // the sources used for records that do not specify one
+	HistoryEnabled    bool     // can records select historical payloads
+	DedupLimit        int      // the maximum number of ids tracked for deduplication
 }
 
 // this is our record implementation
 type recordImpl struct {
 	//RawBytes []byte
-	RecordId string
+	RecordId        string
+	RecordSource    string
+	RecordOperation string
+	RecordPriority  int
+	RecordNote      string
+	RecordVersion   int
+	RecordAsOf      time.Time
+	RecordLine      int
+}
+
+// the plain format, one bare id per line
+type plainDecoder struct {
+	reader *lineReader
 }
 
 // NewRecordLoader - the factory
-func NewRecordLoader(filename string) (RecordLoader, error) {
+func NewRecordLoader(filename string, config *ServiceConfig) (RecordLoader, error) {
 
-	file, err := os.Open(filename)
+	file, err := openDecompressed(filename)
 	if err != nil {
 		return nil, err
 	}
 
-	reader := bufio.NewReader(file)
+	// we always need at least one validation worker
+	workers := config.ValidationWorkers
+	if workers < 1 {
+		workers = 1
+	}
 
-	return &recordLoaderImpl{File: file, Reader: reader}, nil
+	// the decoder is started by First()
+	reader := newLineReader(bufio.NewReader(file), config.ParsePolicy)
+	decoder := newRecordDecoder(filename)
+
+	return &recordLoaderImpl{FileName: filename, File: file, Reader: reader, Decoder: decoder,
+		Policy: config.ParsePolicy, ErrorLimit: config.ValidationErrorLimit, ValidationWorkers: workers,
+		IdRules: config.IdRules, DefaultSources: strings.Split(config.DataSourceNames, " "),
+		HistoryEnabled: len(config.HistoryTable) != 0, DedupLimit: config.DedupMaxKeys}, nil
 }
 
-// read all the records to ensure the file is valid
-func (l *recordLoaderImpl) Validate(cache CacheProxy) error {
+// choose the record decoder based on the file extension (ignoring any compression extension)
+func newRecordDecoder(filename string) recordDecoder {
 
-	if l.File == nil {
-		return ErrFileNotOpen
+	switch strings.ToLower(filepath.Ext(stripCompressionExtension(filename))) {
+	case ".csv":
+		return newDelimitedDecoder(',')
+	case ".tsv":
+		return newDelimitedDecoder('\t')
+	case ".jsonl", ".ndjson":
+		return &jsonlDecoder{}
 	}
 
-	// get the first record and error out if bad. An EOF is OK, just means the file is empty
-	rec, err := l.First()
-	if err != nil {
-		// are we done
-		if err == io.EOF {
-			log.Printf("WARNING: EOF on first read, looks like an empty file")
-			return nil
-		} else {
-			log.Printf("ERROR: validation failure on record index 0")
-			return err
-		}
+	return &plainDecoder{}
+}
+
+// read all the records to ensure the file is valid and return a summary of any problems. An error is returned
+// only if validation could not be completed
+func (l *recordLoaderImpl) Validate(cache CacheProxy) (*ValidationResult, error) {
+
+	if l.File == nil {
+		return nil, ErrFileNotOpen
 	}
 
-	// batch up our cache lookups for performance reasons
-	lookupIds := make([]string, 0, lookupCacheMaxKeyCount)
-	lookupIds = append(lookupIds, rec.Id())
+	result := newValidationResult(l.ErrorLimit)
+
+	// cache lookups are done by a pool of workers, the number of workers bounds the load on the cache
+	batches := make(chan []Record, l.ValidationWorkers)
+	var wg sync.WaitGroup
+	for w := 1; w <= l.ValidationWorkers; w++ {
+		wg.Add(1)
+		go func(batches <-chan []Record) {
+			defer wg.Done()
+			for batch := range batches {
+				validateInCache(cache, batch, result)
+			}
+		}(batches)
+	}
 
-	// used for reporting
-	recordIndex := 1
+	// we must always wait for the workers to finish, even on error
+	defer func() {
+		if batches != nil {
+			close(batches)
+			wg.Wait()
+		}
+	}()
 
-	// read all the records and process until EOF
-	var retErr error
+	// batch up our cache lookups for performance reasons, there is no need to lookup duplicates
+	lookupIds := make([]Record, 0, lookupCacheMaxKeyCount)
+	dedup := newRecordDeduplicator(l.DedupLimit)
 
+	// read all the records and process until EOF. An EOF on the first read is OK, just means the file is empty
+	rec, err := l.First()
 	for {
-		rec, err = l.Next()
-
 		if err != nil {
 			// are we done
 			if err == io.EOF {
 				break
+			}
+
+			// a bad record is noted and we move on, anything else means we cannot continue
+			if errors.Is(err, ErrBadRecord) == false {
+				return nil, err
+			}
+			result.addBadRecord(l.Reader.LineNumber(), l.Reader.RawLine(), err)
+		} else {
+			result.Records++
+			if seen, e := dedup.Seen(rec); e != nil {
+				result.addBadRecord(rec.Line(), rec.Id(), e)
+			} else if seen == true {
+				result.DuplicateCount++
+			} else if len(rec.Source()) != 0 && contains(l.DefaultSources, rec.Source()) == false {
+				// a mistyped source could otherwise send deletes for the wrong source
+				result.addBadRecord(rec.Line(), rec.Id(), badRecord("unknown source [%s]", rec.Source()))
+			} else if e := l.IdRules.Check(rec, l.DefaultSources); e != nil {
+				// no point looking up an id that cannot be valid
+				result.addSyntaxError(rec, e)
+			} else if isHistorical(rec) == true && l.HistoryEnabled == false {
+				result.addBadRecord(rec.Line(), rec.Id(), badRecord("%s requested but %s", historyDescription(rec), ErrNoHistory.Error()))
+			} else if isHistorical(rec) == true && rec.Operation() == awssqs.AttributeValueRecordOperationDelete {
+				result.addBadRecord(rec.Line(), rec.Id(), badRecord("a delete cannot select a historical payload"))
+			} else if rec.Operation() == awssqs.AttributeValueRecordOperationDelete {
+				// deleted records may already be gone from the cache so we do not look them up but we must
+				// know which source they belong to
+				if len(rec.Source()) == 0 && len(l.DefaultSources) != 1 {
+					result.addBadRecord(rec.Line(), rec.Id(), badRecord("delete requires a source when more than one data source is configured"))
+				}
 			} else {
-				log.Printf("ERROR: validation failure on record index %d", recordIndex)
-				return err
+				lookupIds = append(lookupIds, rec)
 			}
 		}
 
-		lookupIds = append(lookupIds, rec.Id())
+		// the worker owns the batch once we hand it over
 		if len(lookupIds) == lookupCacheMaxKeyCount {
+			batches <- lookupIds
+			lookupIds = make([]Record, 0, lookupCacheMaxKeyCount)
+		}
 
-			// lookup in the cache
-			_, err := cache.Exists(lookupIds)
-			if err != nil {
-				// this is an acceptable error, anything else is fatal
-				if err == ErrNotInCache {
-					retErr = err
-				} else {
-					fatalIfError(err)
-				}
-			}
+		rec, err = l.Next()
+	}
 
-			lookupIds = lookupIds[:0]
-		}
-		recordIndex++
+	if len(lookupIds) != 0 {
+		batches <- lookupIds
 	}
 
-	sz := len(lookupIds)
-	if sz != 0 {
+	// wait for the outstanding lookups
+	close(batches)
+	batches = nil
+	wg.Wait()
+	result.sort()
 
-		// lookup in the cache
-		_, err := cache.Exists(lookupIds)
-		// this is an acceptable error, anything else is fatal
-		if err == ErrNotInCache {
-			retErr = err
-		} else {
-			fatalIfError(err)
-		}
+	result.Skipped = l.Skipped()
+	if result.Records == 0 && result.BadRecordCount == 0 {
+		log.Printf("WARNING: no records found, looks like an empty file")
 	}
 
-	// return the appropriate status
-	return retErr
+	return result, nil
+}
+
+// lookup a batch of records in the cache and note any that are missing
+func validateInCache(cache CacheProxy, records []Record, result *ValidationResult) {
+
+	// cache errors are not a problem with the file so they are fatal
+	lookup, err := cache.Lookup(records)
+	fatalIfError(err)
+
+	for _, f := range lookup.Found {
+		result.addFound(f)
+	}
+	for _, m := range lookup.Missing {
+		result.addMissing(m)
+	}
 }
 
 func (l *recordLoaderImpl) First() (Record, error) {
@@ -139,8 +248,17 @@ func (l *recordLoaderImpl) First() (Record, error) {
 		return nil, ErrFileNotOpen
 	}
 
-	// go to the start of the file and then get the next record
-	_, err := l.File.Seek(0, 0)
+	// compressed streams cannot seek so we reopen the file to go back to the start and then get the next record
+	l.File.Close()
+	file, err := openDecompressed(l.FileName)
+	if err != nil {
+		l.File = nil
+		return nil, err
+	}
+
+	l.File = file
+	l.Reader = newLineReader(bufio.NewReader(file), l.Policy)
+	err = l.Decoder.Start(l.Reader)
 	if err != nil {
 		return nil, err
 	}
@@ -154,7 +272,7 @@ func (l *recordLoaderImpl) Next() (Record, error) {
 		return nil, ErrFileNotOpen
 	}
 
-	rec, err := l.recordRead()
+	rec, err := l.Decoder.Decode()
 	if err != nil {
 		return nil, err
 	}
@@ -162,6 +280,83 @@ func (l *recordLoaderImpl) Next() (Record, error) {
 	return rec, nil
 }
 
+// recordDeduplicator - tracks the records we have seen so duplicates can be ignored. Every distinct key is held in
+// memory, roughly 100 bytes each, so the number tracked is limited. Beyond the limit records are no longer
+// deduplicated
+type recordDeduplicator struct {
+	seen       map[string]dedupEntry
+	limit      int  // the maximum number of keys tracked, zero for no limit
+	full       bool // have we reached the limit
+	duplicates int
+}
+
+// what we have seen for a key
+type dedupEntry struct {
+	operation string // the operation of the first record for the id
+	current   bool   // have we seen a record selecting the current payload
+}
+
+func newRecordDeduplicator(limit int) *recordDeduplicator {
+	return &recordDeduplicator{seen: make(map[string]dedupEntry), limit: limit}
+}
+
+// Seen - have we already seen this record (the same id from the same source selecting the same payload), notes it
+// if not. An update and a delete of the same id cannot both be honoured so that is a bad record
+func (d *recordDeduplicator) Seen(rec Record) (bool, error) {
+
+	key := rec.Source() + "/" + rec.Id()
+	entry, found := d.seen[key]
+	if found == true && entry.operation != rec.Operation() {
+		return false, badRecord("conflicting operations %s and %s for id %s", entry.operation, rec.Operation(), rec.Id())
+	}
+
+	// historical selections are tracked under their own keys, the separator cannot appear in an id
+	historical := ""
+	if isHistorical(rec) == true {
+		historical = key + "\x00" + historySelection(rec)
+	}
+
+	if (historical == "" && found == true && entry.current == true) || (historical != "" && d.tracked(historical)) {
+		d.duplicates++
+		return true, nil
+	}
+
+	if d.limit != 0 && len(d.seen) >= d.limit {
+		if d.full == false {
+			log.Printf("WARNING: tracking %d ids, later duplicates will not be ignored", d.limit)
+			d.full = true
+		}
+		return false, nil
+	}
+
+	if historical != "" {
+		d.seen[historical] = dedupEntry{operation: rec.Operation()}
+	}
+	entry.operation = rec.Operation()
+	entry.current = entry.current || historical == ""
+	d.seen[key] = entry
+	return false, nil
+}
+
+func (d *recordDeduplicator) tracked(key string) bool {
+	_, found := d.seen[key]
+	return found
+}
+
+// Duplicates - the number of duplicate records seen
+func (d *recordDeduplicator) Duplicates() int {
+	return d.duplicates
+}
+
+// badRecord - a bad record error including the reason
+func badRecord(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrBadRecord, fmt.Sprintf(format, args...))
+}
+
+func (l *recordLoaderImpl) Skipped() SkippedLines {
+	return l.Reader.Skipped()
+}
+
 func (l *recordLoaderImpl) Done() {
 
 	if l.File != nil {
@@ -170,39 +365,61 @@ func (l *recordLoaderImpl) Done() {
 	}
 }
 
-func (l *recordLoaderImpl) recordRead() (Record, error) {
+func (d *plainDecoder) Start(reader *lineReader) error {
+	d.reader = reader
+	return nil
+}
 
-	id, err := l.Reader.ReadString('\n')
-	if err != nil {
-		// if we encounter end of file, we might have actually read a record check to see if we did
-		if err == io.EOF {
-			if len(id) == 0 {
-				return nil, err
-			}
-		} else {
-			return nil, err
-		}
+func (d *plainDecoder) Decode() (Record, error) {
+
+	if d.reader == nil {
+		return nil, ErrFileNotOpen
 	}
 
-	// remove the newline
-	id = strings.TrimSuffix(id, "\n")
+	id, err := d.reader.ReadLine()
+	if err != nil {
+		return nil, err
+	}
 
 	if len(id) == 0 {
-		return nil, ErrBadRecord
+		return nil, badRecord("empty id")
 	}
 
-	//if id[0] != 'u' {
-	//	log.Printf("ERROR: record id is suspect (%s)", id)
-	//	return nil, ErrBadRecordId
-	//}
-
-	return &recordImpl{RecordId: id}, nil
+	return &recordImpl{RecordId: id, RecordOperation: awssqs.AttributeValueRecordOperationUpdate, RecordLine: d.reader.LineNumber()}, nil
 }
 
 func (r *recordImpl) Id() string {
 	return r.RecordId
 }
 
+func (r *recordImpl) Source() string {
+	return r.RecordSource
+}
+
+func (r *recordImpl) Operation() string {
+	return r.RecordOperation
+}
+
+func (r *recordImpl) Priority() int {
+	return r.RecordPriority
+}
+
+func (r *recordImpl) Note() string {
+	return r.RecordNote
+}
+
+func (r *recordImpl) Version() int {
+	return r.RecordVersion
+}
+
+func (r *recordImpl) AsOf() time.Time {
+	return r.RecordAsOf
+}
+
+func (r *recordImpl) Line() int {
+	return r.RecordLine
+}
+
 //func (r *recordImpl) Raw() []byte {
 //	return r.RawBytes
 //}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrBadTombstone - the tombstone configuration is invalid
+var ErrBadTombstone = fmt.Errorf("bad tombstone configuration")
+
+// TombstoneCondition - a cache row is a tombstone (a withdrawn record) if the column has the value
+type TombstoneCondition struct {
+	Column string
+	Value  string
+}
+
+// Tombstones - the tombstone conditions, a row matching any of them is a tombstone
+type Tombstones []TombstoneCondition
+
+// the columns every cache row has
+var standardCacheColumns = map[string]bool{"id": true, "type": true, "source": true, "payload": true}
+
+// ParseTombstones - parse a space separated list of column=value conditions
+func ParseTombstones(spec string) (Tombstones, error) {
+
+	entries, err := parseKeyValueSpec(spec, ErrBadTombstone, "column=value", false)
+	if err != nil {
+		return nil, err
+	}
+
+	tombstones := make(Tombstones, 0)
+	for _, entry := range entries {
+		if entry.key == "id" || entry.key == "payload" {
+			return nil, fmt.Errorf("%w: [%s] cannot be used as a tombstone column", ErrBadTombstone, entry.key)
+		}
+		tombstones = append(tombstones, TombstoneCondition{Column: entry.key, Value: entry.value})
+	}
+
+	return tombstones, nil
+}
+
+// the additional (non standard) columns the conditions need
+func (t Tombstones) columns() []string {
+
+	columns := make([]string, 0, len(t))
+	for _, c := range t {
+		if standardCacheColumns[c.Column] == false {
+			columns = append(columns, c.Column)
+		}
+	}
+	return columns
+}
+
+// IsTombstone - does the row match any of the conditions
+func (t Tombstones) IsTombstone(r cacheRow) bool {
+
+	for _, c := range t {
+		var value string
+		switch c.Column {
+		case "type":
+			value = r.Type
+		case "source":
+			value = r.Source
+		default:
+			value = r.Extra[c.Column]
+		}
+
+		if tombstoneValueMatches(value, c.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// values match if they are the same ignoring case or if they are the same boolean value (databases have many
+// ways of writing true)
+func tombstoneValueMatches(value string, expected string) bool {
+
+	if strings.EqualFold(value, expected) {
+		return true
+	}
+
+	b1, err1 := strconv.ParseBool(value)
+	b2, err2 := strconv.ParseBool(expected)
+	return err1 == nil && err2 == nil && b1 == b2
+}
+
+//
+// end of file
+//
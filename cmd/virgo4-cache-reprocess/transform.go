@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// ErrBadTransform - the transform configuration is invalid
+var ErrBadTransform = fmt.Errorf("bad transform definition")
+
+// ErrTransformFailed - a transform could not be applied to a payload
+var ErrTransformFailed = fmt.Errorf("payload transform failed")
+
+// the transforms we support
+var transformXMLSet = "xml-set"
+var transformXMLRemove = "xml-remove"
+var transformJSONSet = "json-set"
+var transformJSONRemove = "json-remove"
+var transformSubstitute = "substitute"
+
+// TransformDefinition - the definition of a payload transform, as it appears in the transform file or a job
+// definition. Id files cannot specify transforms
+type TransformDefinition struct {
+	Type    string          `json:"type"`    // the transform type
+	Path    string          `json:"path"`    // the element (slash separated) or field (dot separated) path
+	Value   json.RawMessage `json:"value"`   // the value to set, a string for XML transforms and any JSON value for JSON ones
+	Pattern string          `json:"pattern"` // the regular expression to replace (substitute only)
+	Replace string          `json:"replace"` // and its replacement, may refer to submatches as $1 etc.
+}
+
+// PayloadTransform - a transform applied to a payload before it is sent
+type PayloadTransform interface {
+	Apply([]byte) ([]byte, error)
+}
+
+// Transformer - the transformation stage between the cache and the outbound queue, applies the transforms
+// configured for the message data source
+type Transformer struct {
+	sources map[string][]PayloadTransform // the transforms for each source, "*" applies to any source without its own
+}
+
+// NewTransformer - load the per source transforms from the configured file, a file is not required
+func NewTransformer(config *ServiceConfig) (*Transformer, error) {
+
+	t := &Transformer{sources: make(map[string][]PayloadTransform)}
+	if len(config.TransformFile) == 0 {
+		return t, nil
+	}
+
+	buf, err := ioutil.ReadFile(config.TransformFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var definitions map[string][]TransformDefinition
+	err = json.Unmarshal(buf, &definitions)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadTransform, err.Error())
+	}
+
+	for source, defs := range definitions {
+		t.sources[source], err = NewPayloadTransforms(defs)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", source, err)
+		}
+		log.Printf("INFO: %d transform(s) configured for data source [%s]", len(defs), source)
+	}
+
+	return t, nil
+}
+
+// NewPayloadTransforms - create the transforms from their definitions
+func NewPayloadTransforms(definitions []TransformDefinition) ([]PayloadTransform, error) {
+
+	transforms := make([]PayloadTransform, 0, len(definitions))
+	for _, def := range definitions {
+		t, err := newPayloadTransform(def)
+		if err != nil {
+			return nil, err
+		}
+		transforms = append(transforms, t)
+	}
+
+	return transforms, nil
+}
+
+func newPayloadTransform(def TransformDefinition) (PayloadTransform, error) {
+
+	switch def.Type {
+	case transformXMLSet, transformXMLRemove:
+		path := strings.Split(strings.Trim(def.Path, "/"), "/")
+		if len(path[0]) == 0 {
+			return nil, fmt.Errorf("%w: %s requires a path", ErrBadTransform, def.Type)
+		}
+		if def.Type == transformXMLRemove {
+			return &xmlRemoveTransform{path: path}, nil
+		}
+		var value string
+		if err := json.Unmarshal(def.Value, &value); err != nil {
+			return nil, fmt.Errorf("%w: %s requires a string value", ErrBadTransform, def.Type)
+		}
+		return &xmlSetTransform{path: path, value: value}, nil
+
+	case transformJSONSet, transformJSONRemove:
+		if len(def.Path) == 0 {
+			return nil, fmt.Errorf("%w: %s requires a path", ErrBadTransform, def.Type)
+		}
+		path := strings.Split(def.Path, ".")
+		if def.Type == transformJSONRemove {
+			return &jsonRemoveTransform{path: path}, nil
+		}
+		var value interface{}
+		decoder := json.NewDecoder(bytes.NewReader(def.Value))
+		decoder.UseNumber()
+		if err := decoder.Decode(&value); err != nil {
+			return nil, fmt.Errorf("%w: %s requires a value", ErrBadTransform, def.Type)
+		}
+		return &jsonSetTransform{path: path, value: value}, nil
+
+	case transformSubstitute:
+		re, err := regexp.Compile(def.Pattern)
+		if err != nil || len(def.Pattern) == 0 {
+			return nil, fmt.Errorf("%w: %s requires a valid pattern", ErrBadTransform, def.Type)
+		}
+		return &substituteTransform{pattern: re, replace: []byte(def.Replace)}, nil
+	}
+
+	return nil, fmt.Errorf("%w: unknown transform type [%s]", ErrBadTransform, def.Type)
+}
+
+// Apply - apply the transforms for the message source followed by any additional ones (e.g. from a job).
+// Deletes and compressed payloads are never transformed
+func (t *Transformer) Apply(message *awssqs.Message, additional []PayloadTransform) error {
+
+	transforms := t.forSource(messageAttribute(message, awssqs.AttributeKeyRecordSource))
+	if len(transforms) == 0 && len(additional) == 0 {
+		return nil
+	}
+
+	if messageAttribute(message, awssqs.AttributeKeyRecordOperation) == awssqs.AttributeValueRecordOperationDelete ||
+		len(messageAttribute(message, attributeKeyContentEncoding)) != 0 {
+		return nil
+	}
+
+	payload := message.Payload
+	var err error
+	for _, tr := range append(append([]PayloadTransform{}, transforms...), additional...) {
+		payload, err = tr.Apply(payload)
+		if err != nil {
+			id := messageAttribute(message, awssqs.AttributeKeyRecordId)
+			log.Printf("ERROR: transforming id %s: %s", id, err.Error())
+			return fmt.Errorf("%w: id %s: %s", ErrTransformFailed, id, err.Error())
+		}
+	}
+
+	message.Payload = payload
+	return nil
+}
+
+// the transforms for the specified source
+func (t *Transformer) forSource(source string) []PayloadTransform {
+
+	if transforms, found := t.sources[source]; found == true {
+		return transforms
+	}
+	return t.sources[anyKey]
+}
+
+// the value of the named message attribute, empty if it does not exist
+func messageAttribute(message *awssqs.Message, name string) string {
+	for _, a := range message.Attribs {
+		if a.Name == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+//
+// the substitute transform
+//
+
+type substituteTransform struct {
+	pattern *regexp.Regexp
+	replace []byte
+}
+
+func (st *substituteTransform) Apply(payload []byte) ([]byte, error) {
+	return st.pattern.ReplaceAll(payload, st.replace), nil
+}
+
+//
+// the JSON transforms, the payload must be a JSON object. Note that fields are written in sorted order
+//
+
+type jsonSetTransform struct {
+	path  []string
+	value interface{}
+}
+
+type jsonRemoveTransform struct {
+	path []string
+}
+
+func (jt *jsonSetTransform) Apply(payload []byte) ([]byte, error) {
+
+	doc, err := decodeJSONObject(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	// intermediate objects are created as necessary
+	obj := doc
+	for _, field := range jt.path[:len(jt.path)-1] {
+		child, ok := obj[field].(map[string]interface{})
+		if ok == false {
+			if _, exists := obj[field]; exists == true {
+				return nil, fmt.Errorf("field %s is not an object", field)
+			}
+			child = make(map[string]interface{})
+			obj[field] = child
+		}
+		obj = child
+	}
+	obj[jt.path[len(jt.path)-1]] = jt.value
+
+	return json.Marshal(doc)
+}
+
+func (jt *jsonRemoveTransform) Apply(payload []byte) ([]byte, error) {
+
+	doc, err := decodeJSONObject(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	// nothing to do if any part of the path does not exist
+	obj := doc
+	for _, field := range jt.path[:len(jt.path)-1] {
+		child, ok := obj[field].(map[string]interface{})
+		if ok == false {
+			return payload, nil
+		}
+		obj = child
+	}
+	if _, exists := obj[jt.path[len(jt.path)-1]]; exists == false {
+		return payload, nil
+	}
+	delete(obj, jt.path[len(jt.path)-1])
+
+	return json.Marshal(doc)
+}
+
+// decode a JSON object payload preserving number formatting
+func decodeJSONObject(payload []byte) (map[string]interface{}, error) {
+
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+
+	var doc map[string]interface{}
+	err := decoder.Decode(&doc)
+	if err != nil {
+		return nil, fmt.Errorf("payload is not a JSON object: %s", err.Error())
+	}
+	return doc, nil
+}
+
+//
+// the XML transforms. Elements are located by the local names on the path from the root and the payload is
+// edited in place so everything else (formatting, namespaces, declarations) is left as is
+//
+
+type xmlSetTransform struct {
+	path  []string
+	value string
+}
+
+type xmlRemoveTransform struct {
+	path []string
+}
+
+// the location of an element in the payload
+type xmlElement struct {
+	start        int // the start of the start tag
+	contentStart int // the end of the start tag
+	contentEnd   int // the start of the end tag
+	end          int // the end of the end tag
+}
+
+// an edit to the payload, replace the bytes in [from, to)
+type xmlEdit struct {
+	from int
+	to   int
+	text []byte
+}
+
+// set the content of every matching element, creating it in the parent element(s) if there are none
+func (xt *xmlSetTransform) Apply(payload []byte) ([]byte, error) {
+
+	matches, parents, err := findXMLElements(payload, xt.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var escaped bytes.Buffer
+	xml.EscapeText(&escaped, []byte(xt.value))
+
+	edits := make([]xmlEdit, 0, len(matches))
+	if len(matches) != 0 {
+		for _, e := range matches {
+			edits = append(edits, setXMLContent(payload, e, escaped.Bytes()))
+		}
+	} else {
+		if len(parents) == 0 {
+			return nil, fmt.Errorf("no element /%s to add %s to", strings.Join(xt.path[:len(xt.path)-1], "/"), xt.path[len(xt.path)-1])
+		}
+		name := xt.path[len(xt.path)-1]
+		element := []byte(fmt.Sprintf("<%s>%s</%s>", name, escaped.String(), name))
+		for _, p := range parents {
+			if p.contentStart == p.contentEnd && isSelfClosing(payload, p) {
+				edits = append(edits, setXMLContent(payload, p, element))
+			} else {
+				edits = append(edits, xmlEdit{from: p.contentEnd, to: p.contentEnd, text: element})
+			}
+		}
+	}
+
+	return applyXMLEdits(payload, edits), nil
+}
+
+// remove every matching element
+func (xt *xmlRemoveTransform) Apply(payload []byte) ([]byte, error) {
+
+	matches, _, err := findXMLElements(payload, xt.path)
+	if err != nil {
+		return nil, err
+	}
+
+	edits := make([]xmlEdit, 0, len(matches))
+	for _, e := range matches {
+		edits = append(edits, xmlEdit{from: e.start, to: e.end})
+	}
+
+	return applyXMLEdits(payload, edits), nil
+}
+
+// locate the elements matching the path and the elements matching its parent path
+func findXMLElements(payload []byte, path []string) ([]xmlElement, []xmlElement, error) {
+
+	matches := make([]xmlElement, 0)
+	parents := make([]xmlElement, 0)
+
+	// the currently open elements and their names
+	stack := make([]xmlElement, 0, len(path)+1)
+	names := make([]string, 0, len(path)+1)
+
+	decoder := xml.NewDecoder(bytes.NewReader(payload))
+	for {
+		before := int(decoder.InputOffset())
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("payload is not valid XML: %s", err.Error())
+		}
+		after := int(decoder.InputOffset())
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			stack = append(stack, xmlElement{start: before, contentStart: after})
+			names = append(names, t.Name.Local)
+
+		case xml.EndElement:
+			e := stack[len(stack)-1]
+			e.contentEnd = before
+			e.end = after
+
+			// a self closing element has an end token with no width
+			if before == after {
+				e.contentEnd = e.contentStart
+			}
+
+			if xmlPathMatches(names, path) {
+				matches = append(matches, e)
+			} else if xmlPathMatches(names, path[:len(path)-1]) {
+				parents = append(parents, e)
+			}
+			stack = stack[:len(stack)-1]
+			names = names[:len(names)-1]
+		}
+	}
+
+	return matches, parents, nil
+}
+
+// do the open element names match the path exactly
+func xmlPathMatches(names []string, path []string) bool {
+
+	if len(names) != len(path) {
+		return false
+	}
+	for ix := range path {
+		if names[ix] != path[ix] {
+			return false
+		}
+	}
+	return true
+}
+
+// replace the element content, a self closing element is expanded into start and end tags
+func setXMLContent(payload []byte, e xmlElement, content []byte) xmlEdit {
+
+	if e.contentStart == e.contentEnd && isSelfClosing(payload, e) {
+		tag := bytes.TrimRight(payload[e.start:e.contentStart-2], " \t\r\n")
+		name := xmlRawName(tag)
+		text := make([]byte, 0, len(tag)+len(content)+len(name)+4)
+		text = append(text, tag...)
+		text = append(text, '>')
+		text = append(text, content...)
+		text = append(text, "</"...)
+		text = append(text, name...)
+		text = append(text, '>')
+		return xmlEdit{from: e.start, to: e.end, text: text}
+	}
+
+	return xmlEdit{from: e.contentStart, to: e.contentEnd, text: content}
+}
+
+// is this a self closing element, i.e. <name/>
+func isSelfClosing(payload []byte, e xmlElement) bool {
+	return e.contentStart >= 2 && string(payload[e.contentStart-2:e.contentStart]) == "/>"
+}
+
+// the element name (including any namespace prefix) from the raw start tag
+func xmlRawName(tag []byte) []byte {
+	name := tag[1:]
+	if ix := bytes.IndexAny(name, " \t\r\n/>"); ix != -1 {
+		name = name[:ix]
+	}
+	return name
+}
+
+// apply the edits, which do not overlap, from the end of the payload so the offsets remain valid
+func applyXMLEdits(payload []byte, edits []xmlEdit) []byte {
+
+	result := append([]byte{}, payload...)
+	for ix := len(edits) - 1; ix >= 0; ix-- {
+		e := edits[ix]
+		result = append(result[:e.from], append(append([]byte{}, e.text...), result[e.to:]...)...)
+	}
+	return result
+}
+
+//
+// end of file
+//
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestXMLTransforms(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		def     TransformDefinition
+		payload string
+		want    string
+	}{
+		{
+			name:    "set existing element",
+			def:     TransformDefinition{Type: transformXMLSet, Path: "/doc/title", Value: json.RawMessage(`"new"`)},
+			payload: `<doc><title>old</title><author>a</author></doc>`,
+			want:    `<doc><title>new</title><author>a</author></doc>`,
+		},
+		{
+			name:    "set every matching element",
+			def:     TransformDefinition{Type: transformXMLSet, Path: "doc/title", Value: json.RawMessage(`"new"`)},
+			payload: `<doc><title>one</title><title>two</title></doc>`,
+			want:    `<doc><title>new</title><title>new</title></doc>`,
+		},
+		{
+			name:    "set escapes the value",
+			def:     TransformDefinition{Type: transformXMLSet, Path: "doc/title", Value: json.RawMessage(`"a < b & c"`)},
+			payload: `<doc><title>old</title></doc>`,
+			want:    `<doc><title>a &lt; b &amp; c</title></doc>`,
+		},
+		{
+			name:    "set ignores nested elements with the same name",
+			def:     TransformDefinition{Type: transformXMLSet, Path: "doc/item", Value: json.RawMessage(`"x"`)},
+			payload: `<doc><item><item>inner</item></item><group><item>other</item></group></doc>`,
+			want:    `<doc><item>x</item><group><item>other</item></group></doc>`,
+		},
+		{
+			name:    "set nested path",
+			def:     TransformDefinition{Type: transformXMLSet, Path: "doc/group/item", Value: json.RawMessage(`"x"`)},
+			payload: `<doc><item>top</item><group><item>one</item></group><group><item>two</item></group></doc>`,
+			want:    `<doc><item>top</item><group><item>x</item></group><group><item>x</item></group></doc>`,
+		},
+		{
+			name:    "set self closing element",
+			def:     TransformDefinition{Type: transformXMLSet, Path: "doc/title", Value: json.RawMessage(`"new"`)},
+			payload: `<doc><title attr="1" /></doc>`,
+			want:    `<doc><title attr="1">new</title></doc>`,
+		},
+		{
+			name:    "set creates element in parent",
+			def:     TransformDefinition{Type: transformXMLSet, Path: "doc/title", Value: json.RawMessage(`"new"`)},
+			payload: `<doc><author>a</author></doc>`,
+			want:    `<doc><author>a</author><title>new</title></doc>`,
+		},
+		{
+			name:    "set creates element in self closing parent",
+			def:     TransformDefinition{Type: transformXMLSet, Path: "doc/meta/title", Value: json.RawMessage(`"new"`)},
+			payload: `<doc><meta/><meta></meta></doc>`,
+			want:    `<doc><meta><title>new</title></meta><meta><title>new</title></meta></doc>`,
+		},
+		{
+			name:    "set namespaced element",
+			def:     TransformDefinition{Type: transformXMLSet, Path: "doc/title", Value: json.RawMessage(`"new"`)},
+			payload: `<d:doc xmlns:d="urn:d"><d:title>old</d:title><d:title/></d:doc>`,
+			want:    `<d:doc xmlns:d="urn:d"><d:title>new</d:title><d:title>new</d:title></d:doc>`,
+		},
+		{
+			name:    "set with xml declaration",
+			def:     TransformDefinition{Type: transformXMLSet, Path: "doc/title", Value: json.RawMessage(`"new"`)},
+			payload: "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<doc>\n  <title>old</title>\n</doc>\n",
+			want:    "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<doc>\n  <title>new</title>\n</doc>\n",
+		},
+		{
+			name:    "remove every matching element",
+			def:     TransformDefinition{Type: transformXMLRemove, Path: "doc/title"},
+			payload: `<doc><title>one</title><author>a</author><title/></doc>`,
+			want:    `<doc><author>a</author></doc>`,
+		},
+		{
+			name:    "remove nested path",
+			def:     TransformDefinition{Type: transformXMLRemove, Path: "doc/group/item"},
+			payload: `<doc><item>top</item><group><item>one</item><item><item/></item></group></doc>`,
+			want:    `<doc><item>top</item><group></group></doc>`,
+		},
+		{
+			name:    "remove namespaced element with xml declaration",
+			def:     TransformDefinition{Type: transformXMLRemove, Path: "doc/title"},
+			payload: `<?xml version="1.0"?><d:doc xmlns:d="urn:d"><d:title>old</d:title></d:doc>`,
+			want:    `<?xml version="1.0"?><d:doc xmlns:d="urn:d"></d:doc>`,
+		},
+		{
+			name:    "remove missing element",
+			def:     TransformDefinition{Type: transformXMLRemove, Path: "doc/title"},
+			payload: `<doc><author>a</author></doc>`,
+			want:    `<doc><author>a</author></doc>`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := applyTransform(t, tc.def, tc.payload)
+			if got != tc.want {
+				t.Errorf("got  %s\nwant %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestXMLTransformErrors(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		def     TransformDefinition
+		payload string
+	}{
+		{
+			name:    "set without parent",
+			def:     TransformDefinition{Type: transformXMLSet, Path: "doc/meta/title", Value: json.RawMessage(`"new"`)},
+			payload: `<doc><author>a</author></doc>`,
+		},
+		{
+			name:    "invalid payload",
+			def:     TransformDefinition{Type: transformXMLRemove, Path: "doc/title"},
+			payload: `<doc><title>old</doc>`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tr, err := newPayloadTransform(tc.def)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = tr.Apply([]byte(tc.payload)); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func TestJSONTransforms(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		def     TransformDefinition
+		payload string
+		want    string
+	}{
+		{
+			name:    "set existing field",
+			def:     TransformDefinition{Type: transformJSONSet, Path: "title", Value: json.RawMessage(`"new"`)},
+			payload: `{"title":"old","count":12345678901234567890}`,
+			want:    `{"count":12345678901234567890,"title":"new"}`,
+		},
+		{
+			name:    "set nested field",
+			def:     TransformDefinition{Type: transformJSONSet, Path: "meta.rights", Value: json.RawMessage(`{"open":true}`)},
+			payload: `{"meta":{"rights":null,"year":1999}}`,
+			want:    `{"meta":{"rights":{"open":true},"year":1999}}`,
+		},
+		{
+			name:    "set missing path creates objects",
+			def:     TransformDefinition{Type: transformJSONSet, Path: "meta.admin.flag", Value: json.RawMessage(`1.50`)},
+			payload: `{"title":"a"}`,
+			want:    `{"meta":{"admin":{"flag":1.50}},"title":"a"}`,
+		},
+		{
+			name:    "remove field",
+			def:     TransformDefinition{Type: transformJSONRemove, Path: "meta.year"},
+			payload: `{"meta":{"year":1999,"month":1}}`,
+			want:    `{"meta":{"month":1}}`,
+		},
+		{
+			name:    "remove missing field leaves payload as is",
+			def:     TransformDefinition{Type: transformJSONRemove, Path: "meta.day"},
+			payload: `{"meta": {"year": 1999}}`,
+			want:    `{"meta": {"year": 1999}}`,
+		},
+		{
+			name:    "remove missing parent leaves payload as is",
+			def:     TransformDefinition{Type: transformJSONRemove, Path: "admin.flag"},
+			payload: `{"meta": {"year": 1999}}`,
+			want:    `{"meta": {"year": 1999}}`,
+		},
+		{
+			name:    "remove through a non object leaves payload as is",
+			def:     TransformDefinition{Type: transformJSONRemove, Path: "meta.year.value"},
+			payload: `{"meta": {"year": 1999}}`,
+			want:    `{"meta": {"year": 1999}}`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := applyTransform(t, tc.def, tc.payload)
+			if got != tc.want {
+				t.Errorf("got  %s\nwant %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestJSONTransformErrors(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		def     TransformDefinition
+		payload string
+	}{
+		{
+			name:    "set through a non object",
+			def:     TransformDefinition{Type: transformJSONSet, Path: "meta.year.value", Value: json.RawMessage(`1`)},
+			payload: `{"meta":{"year":1999}}`,
+		},
+		{
+			name:    "payload is not an object",
+			def:     TransformDefinition{Type: transformJSONRemove, Path: "title"},
+			payload: `["title"]`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tr, err := newPayloadTransform(tc.def)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = tr.Apply([]byte(tc.payload)); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func applyTransform(t *testing.T, def TransformDefinition, payload string) string {
+
+	t.Helper()
+	tr, err := newPayloadTransform(def)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := tr.Apply([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(result)
+}
+
+//
+// end of file
+//
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uvalib/uva-aws-s3-sdk/uva-s3"
+)
+
+// ValidationResult - the outcome of validating an input file
+type ValidationResult struct {
+	Records int          `json:"records"` // the number of well formed records
+	Skipped SkippedLines `json:"skipped"` // lines ignored because of the parse policy
+
+	DuplicateCount int            `json:"duplicate_count"` // records that repeat an earlier record, these are ignored
+	SourceCounts   map[string]int `json:"source_counts"`   // the number of records found in each data source
+	MultiSource    int            `json:"multi_source"`    // records found in more than one data source
+
+	BadRecordCount int               `json:"bad_record_count"` // the total number of malformed lines
+	BadRecords     []ValidationError `json:"bad_records"`      // the malformed lines (up to the limit)
+	SyntaxCount    int               `json:"syntax_count"`     // the total number of records with an invalid id
+	SyntaxErrors   []ValidationError `json:"syntax_errors"`    // the records with an invalid id (up to the limit)
+	MissingCount   int               `json:"missing_count"`    // the total number of records not in the cache
+	Missing        []ValidationError `json:"missing"`          // the records not in the cache (up to the limit)
+
+	limit int        // the maximum number of problems of each kind we keep
+	mu    sync.Mutex // problems may be added concurrently
+}
+
+// ValidationReport - a validation result as written to the validation report
+type ValidationReport struct {
+	File  string    `json:"file"`  // the validated file
+	When  time.Time `json:"when"`  // when it was validated
+	Valid bool      `json:"valid"` // did it pass validation
+	*ValidationResult
+}
+
+// ValidationError - a single validation problem
+type ValidationError struct {
+	Line    int    `json:"line"`    // the line number in the input file
+	Content string `json:"content"` // the line content or record id
+	Reason  string `json:"reason"`  // what is wrong with it
+}
+
+func newValidationResult(limit int) *ValidationResult {
+	return &ValidationResult{
+		BadRecords:   make([]ValidationError, 0),
+		SyntaxErrors: make([]ValidationError, 0),
+		Missing:      make([]ValidationError, 0),
+		SourceCounts: make(map[string]int),
+		limit:        limit,
+	}
+}
+
+// Valid - did the file pass validation
+func (vr *ValidationResult) Valid() bool {
+	return vr.BadRecordCount == 0 && vr.SyntaxCount == 0 && vr.MissingCount == 0
+}
+
+// Error - a summary of the problems found, suitable for use as an error
+func (vr *ValidationResult) Error() error {
+	if vr.Valid() == true {
+		return nil
+	}
+	return fmt.Errorf("%w: %d malformed record(s), %d invalid id(s), %d record(s) not in cache", ErrValidationFailed,
+		vr.BadRecordCount, vr.SyntaxCount, vr.MissingCount)
+}
+
+// Log - log the details of the validation result
+func (vr *ValidationResult) Log(name string) {
+
+	log.Printf("INFO: %s: %d record(s), %d duplicate(s), %d malformed, %d invalid id(s), %d not in cache, %d blank and %d comment line(s) skipped",
+		name, vr.Records, vr.DuplicateCount, vr.BadRecordCount, vr.SyntaxCount, vr.MissingCount, vr.Skipped.Blank, vr.Skipped.Comment)
+
+	for source, count := range vr.SourceCounts {
+		log.Printf("INFO: %s: %d record(s) found in source %s", name, count, source)
+	}
+	if vr.MultiSource != 0 {
+		log.Printf("WARNING: %s: %d record(s) found in more than one source", name, vr.MultiSource)
+	}
+
+	for _, e := range vr.BadRecords {
+		log.Printf("ERROR: %s line %d: %s [%s]", name, e.Line, e.Reason, e.Content)
+	}
+	if vr.BadRecordCount > len(vr.BadRecords) {
+		log.Printf("ERROR: %s: %d additional malformed record(s) not shown", name, vr.BadRecordCount-len(vr.BadRecords))
+	}
+
+	for _, e := range vr.SyntaxErrors {
+		log.Printf("ERROR: %s line %d: %s [%s]", name, e.Line, e.Reason, e.Content)
+	}
+	if vr.SyntaxCount > len(vr.SyntaxErrors) {
+		log.Printf("ERROR: %s: %d additional invalid id(s) not shown", name, vr.SyntaxCount-len(vr.SyntaxErrors))
+	}
+
+	for _, e := range vr.Missing {
+		log.Printf("ERROR: %s line %d: %s [%s]", name, e.Line, e.Reason, e.Content)
+	}
+	if vr.MissingCount > len(vr.Missing) {
+		log.Printf("ERROR: %s: %d additional record(s) not in cache not shown", name, vr.MissingCount-len(vr.Missing))
+	}
+}
+
+// Store - write the validation result as a JSON report to the bucket, one object per validated file named so
+// reports for the same file sort by time
+func (vr *ValidationResult) Store(s3 uva_s3.UvaS3, bucket string, prefix string, name string) error {
+
+	report := ValidationReport{File: name, When: time.Now().UTC(), Valid: vr.Valid(), ValidationResult: vr}
+	buf, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("%s%s-%s.json", prefix, strings.ReplaceAll(name, "/", "_"), report.When.Format("20060102T150405.000000000Z"))
+	err = s3.PutFromBuffer(uva_s3.NewUvaS3Object(bucket, key), buf)
+	if err != nil {
+		return fmt.Errorf("writing validation report for %s: %s", name, err.Error())
+	}
+
+	log.Printf("INFO: %s: validation report written to %s/%s", name, bucket, key)
+	return nil
+}
+
+// order the problems by line number, they may be found out of order when validating concurrently
+func (vr *ValidationResult) sort() {
+	sort.SliceStable(vr.BadRecords, func(i, j int) bool { return vr.BadRecords[i].Line < vr.BadRecords[j].Line })
+	sort.SliceStable(vr.SyntaxErrors, func(i, j int) bool { return vr.SyntaxErrors[i].Line < vr.SyntaxErrors[j].Line })
+	sort.SliceStable(vr.Missing, func(i, j int) bool { return vr.Missing[i].Line < vr.Missing[j].Line })
+}
+
+func (vr *ValidationResult) addBadRecord(line int, content string, err error) {
+	vr.mu.Lock()
+	defer vr.mu.Unlock()
+	vr.BadRecordCount++
+	if len(vr.BadRecords) < vr.limit {
+		vr.BadRecords = append(vr.BadRecords, ValidationError{Line: line, Content: content, Reason: err.Error()})
+	}
+}
+
+func (vr *ValidationResult) addSyntaxError(rec Record, err error) {
+	vr.mu.Lock()
+	defer vr.mu.Unlock()
+	vr.SyntaxCount++
+	if len(vr.SyntaxErrors) < vr.limit {
+		vr.SyntaxErrors = append(vr.SyntaxErrors, ValidationError{Line: rec.Line(), Content: rec.Id(), Reason: err.Error()})
+	}
+}
+
+func (vr *ValidationResult) addFound(found FoundRecord) {
+	vr.mu.Lock()
+	defer vr.mu.Unlock()
+	for _, source := range found.Sources {
+		vr.SourceCounts[source]++
+	}
+	if len(found.Sources) > 1 {
+		vr.MultiSource++
+	}
+}
+
+// missing records are found concurrently and so out of order, we keep the ones with the lowest line numbers
+func (vr *ValidationResult) addMissing(rec Record) {
+	vr.mu.Lock()
+	defer vr.mu.Unlock()
+	vr.MissingCount++
+	vr.Missing = append(vr.Missing, ValidationError{Line: rec.Line(), Content: rec.Id(), Reason: ErrNotInCache.Error()})
+	if len(vr.Missing) > vr.limit {
+		sort.SliceStable(vr.Missing, func(i, j int) bool { return vr.Missing[i].Line < vr.Missing[j].Line })
+		vr.Missing = vr.Missing[:vr.limit]
+	}
+}
+
+//
+// end of file
+//
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/uvalib/uva-aws-s3-sdk/uva-s3"
+)
+
+// WatermarkStore - persists the point reached by recurring incremental jobs
+type WatermarkStore interface {
+	Get(string) (time.Time, bool, error) // the watermark and whether one exists
+	Put(string, time.Time) error
+}
+
+// our S3 implementation, one object per watermark
+type s3WatermarkStore struct {
+	s3     uva_s3.UvaS3
+	bucket string
+	prefix string
+}
+
+// NewWatermarkStore - our factory, returns nil if watermarks are not configured
+func NewWatermarkStore(config *ServiceConfig, s3 uva_s3.UvaS3) WatermarkStore {
+
+	if len(config.WatermarkBucket) == 0 {
+		return nil
+	}
+
+	return &s3WatermarkStore{s3: s3, bucket: config.WatermarkBucket, prefix: config.WatermarkPrefix}
+}
+
+func (ws *s3WatermarkStore) Get(name string) (time.Time, bool, error) {
+
+	o := uva_s3.NewUvaS3Object(ws.bucket, ws.key(name))
+	buf, err := ws.s3.GetToBuffer(o)
+	if err != nil {
+		// a watermark that does not exist yet is not an error
+		if err == uva_s3.ErrNotFound {
+			return time.Time{}, false, nil
+		}
+		return time.Time{}, false, err
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(buf)))
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("watermark %s is invalid (%s)", name, err.Error())
+	}
+
+	return t, true, nil
+}
+
+func (ws *s3WatermarkStore) Put(name string, watermark time.Time) error {
+
+	o := uva_s3.NewUvaS3Object(ws.bucket, ws.key(name))
+	return ws.s3.PutFromBuffer(o, []byte(watermark.UTC().Format(time.RFC3339Nano)))
+}
+
+func (ws *s3WatermarkStore) key(name string) string {
+	return ws.prefix + name
+}
+
+//
+// end of file
+//